@@ -0,0 +1,218 @@
+package ai
+
+import (
+	"fmt"
+	"github.com/disintegrator/inv"
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/blot/internal/chunk"
+	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/blot/internal/db/vec"
+	"log/slog"
+	"reflect"
+	"unicode/utf8"
+)
+
+const defaultEmbedBatchSize = 64
+const defaultEmbedBatchTokens = 60_000
+
+type Document struct {
+	Label   string
+	Name    string
+	Content string
+}
+
+type chunkedDocument struct {
+	Document
+	chunks []string
+}
+
+// AddDocument chunks the content of a document, embeds each chunk and stores them as fragments sharing the document
+// name. Nothing is embedded if the stored chunks of the document are unchanged, in which case no fragments are returned
+func AddDocument(cfg *Conf, label string, document string, content string) ([]db.Fragment, error) {
+	return AddDocuments(cfg, []Document{{Label: label, Name: document, Content: content}})
+}
+
+// AddDocuments adds documents as AddDocument does, but embeds the chunks of many documents in each request, up to
+// the batch size and token limits, and stores the fragments of each batch in one transaction
+func AddDocuments(cfg *Conf, docs []Document) ([]db.Fragment, error) {
+	err := recordMetric(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirty []chunkedDocument
+	for _, doc := range docs {
+		chunks, err := chunk.Split(doc.Content, cfg.chunking)
+		if err != nil {
+			return nil, fmt.Errorf("failed to chunk %s: %w", doc.Name, err)
+		}
+
+		isDirty, err := cfg.Dao.DirtyFragment(cfg.ctx, doc.Label, doc.Name, cfg.EmbedModel.String(), chunks)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check fragment dirty state for %s with label %s: %w", doc.Name, doc.Label, err)
+		}
+		if !isDirty {
+			slog.Default().Debug("skipping already existing document", "document", doc.Name, "label", doc.Label)
+			continue
+		}
+		dirty = append(dirty, chunkedDocument{Document: doc, chunks: chunks})
+	}
+
+	var frags []db.Fragment
+	for _, batch := range batchDocuments(dirty, cfg.batchSize, cfg.batchTokens) {
+		added, err := addBatch(cfg, batch)
+		if err != nil {
+			return frags, err
+		}
+		frags = append(frags, added...)
+	}
+	return frags, nil
+}
+
+// batchDocuments groups documents so that the chunks of a group fits within size and tokens. A document that by
+// itself exceeds the limits is put in a group of its own, and is embedded using several requests
+func batchDocuments(docs []chunkedDocument, size int, tokens int) [][]chunkedDocument {
+	var batches [][]chunkedDocument
+	var batch []chunkedDocument
+	var batchSize, batchTokens int
+
+	for _, doc := range docs {
+		docTokens := estimateTokens(doc.chunks...)
+		if len(batch) > 0 && (batchSize+len(doc.chunks) > size || batchTokens+docTokens > tokens) {
+			batches = append(batches, batch)
+			batch, batchSize, batchTokens = nil, 0, 0
+		}
+		batch = append(batch, doc)
+		batchSize += len(doc.chunks)
+		batchTokens += docTokens
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// estimateTokens approximates the number of tokens in texts, assuming four characters per token
+func estimateTokens(texts ...string) int {
+	var tokens int
+	for _, text := range texts {
+		tokens += utf8.RuneCountInString(text)/4 + 1
+	}
+	return tokens
+}
+
+func addBatch(cfg *Conf, batch []chunkedDocument) ([]db.Fragment, error) {
+	model := cfg.EmbedModel
+	model.Type = embed.TypeDocument
+
+	var texts []string
+	for _, doc := range batch {
+		texts = append(texts, doc.chunks...)
+	}
+
+	vectors, err := embedTexts(cfg, model, texts)
+	if err != nil {
+		return nil, err
+	}
+
+	// loading the index before writing, it is needed to index the new fragments
+	_, err = cfg.annIndex(model.String())
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := cfg.db.BeginTx(cfg.ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	dao := cfg.Dao.WithTx(tx)
+
+	var frags []db.Fragment
+	for _, doc := range batch {
+		// the number of chunks may have changed, so all old chunks of the document are replaced
+		_, err = dao.DeleteDocument(cfg.ctx, doc.Label, doc.Name, model.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove old chunks of %s: %w", doc.Name, err)
+		}
+
+		for i, content := range doc.chunks {
+			vector := vectors[0]
+			vectors = vectors[1:]
+
+			frag, err := dao.AddFragment(cfg.ctx, db.AddFragmentParams{
+				Label:           doc.Label,
+				Name:            chunkName(doc.Name, i, len(doc.chunks)),
+				Document:        doc.Name,
+				ChunkIndex:      i,
+				Content:         content,
+				EmbeddingModel:  model.String(),
+				EmbeddingVector: vector,
+				Encoding:        cfg.encoding,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to add fragment: %w", err)
+			}
+
+			// the encoding may be lossy, so the stored vector is compared to the original after the same round trip
+			encoded, _ := vec.Decode(vec.Encode(vector, cfg.encoding))
+			inv.Require("resulting embedding must mach original",
+				"vectors shall be equal", reflect.DeepEqual(encoded, frag.EmbeddingVector))
+
+			frags = append(frags, frag)
+		}
+	}
+
+	err = indexFragments(cfg, dao, frags)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit fragments: %w", err)
+	}
+	return frags, nil
+}
+
+// embedTexts embeds texts using as few requests as the batch size and token limits allows
+func embedTexts(cfg *Conf, model embed.Model, texts []string) ([][]float64, error) {
+	var vectors [][]float64
+	for len(texts) > 0 {
+		n := 1
+		tokens := estimateTokens(texts[0])
+		for n < len(texts) && n < cfg.batchSize {
+			t := estimateTokens(texts[n])
+			if tokens+t > cfg.batchTokens {
+				break
+			}
+			tokens += t
+			n++
+		}
+
+		slog.Default().Debug("embedding batch", "texts", n, "estimated-tokens", tokens)
+		resp, err := cfg.Proxy.EmbedBatch(BatchRequest{
+			Ctx:   cfg.ctx,
+			Model: model,
+			Texts: texts[:n],
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed: %w", err)
+		}
+		if len(resp.Embeddings) != n {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", n, len(resp.Embeddings))
+		}
+		vectors = append(vectors, resp.Embeddings...)
+		texts = texts[n:]
+	}
+	return vectors, nil
+}
+
+// chunkName names the fragment of a chunk. A document that fits in one chunk keeps its name, which means that
+// fragments added before chunking was introduced does not need to be embedded again
+func chunkName(document string, index int, count int) string {
+	if count == 1 {
+		return document
+	}
+	return fmt.Sprintf("%s#%d", document, index)
+}
@@ -0,0 +1,213 @@
+package ai
+
+import (
+	"fmt"
+	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/blot/internal/db/vec"
+	"github.com/modfin/henry/slicez"
+	"log/slog"
+	"math"
+	"sync"
+)
+
+// annMinFragments is the number of fragments of an embedding model at which add builds an index, if there is none
+const annMinFragments = 1000
+
+// annSamplePerList is the number of vectors per centroid that the centroids are trained on
+const annSamplePerList = 32
+
+const annIterations = 10
+
+// annPageSize is the number of vectors read at a time when assigning fragments to centroids
+const annPageSize = 1000
+
+type annIndex struct {
+	ids     []int
+	vectors [][]float64
+}
+
+type annCache struct {
+	mu      sync.Mutex
+	indexes map[string]*annIndex
+}
+
+// annIndex returns the index of an embedding model, or nil if there is no index
+func (cfg *Conf) annIndex(embeddingModel string) (*annIndex, error) {
+	cfg.ann.mu.Lock()
+	defer cfg.ann.mu.Unlock()
+
+	if idx, ok := cfg.ann.indexes[embeddingModel]; ok {
+		return idx, nil
+	}
+
+	centroids, err := cfg.Dao.Centroids(cfg.ctx, embeddingModel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load centroids: %w", err)
+	}
+	var idx *annIndex
+	if len(centroids) > 0 {
+		idx = &annIndex{
+			ids:     slicez.Map(centroids, func(c db.Centroid) int { return c.ID }),
+			vectors: slicez.Map(centroids, func(c db.Centroid) []float64 { return c.Vector }),
+		}
+	}
+	cfg.ann.indexes[embeddingModel] = idx
+	return idx, nil
+}
+
+func (cfg *Conf) dropAnnIndex(embeddingModel string) {
+	cfg.ann.mu.Lock()
+	defer cfg.ann.mu.Unlock()
+	delete(cfg.ann.indexes, embeddingModel)
+}
+
+// BuildIndex (re)builds the approximate nearest neighbour index of the embedding model in use. The index is an
+// inverted file, where fragments are listed under the closest of sqrt(n) centroids trained by k-means
+func BuildIndex(cfg *Conf) (int, error) {
+	model := cfg.EmbedModel.String()
+	logger := slog.Default().With("embed-model", model)
+
+	n, err := cfg.Dao.CountFragments(cfg.ctx, model)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count fragments: %w", err)
+	}
+	k := int(math.Ceil(math.Sqrt(float64(n))))
+
+	logger.Debug("training centroids", "fragments", n, "centroids", k)
+	sample, err := cfg.Dao.SampleFragmentVectors(cfg.ctx, model, k*annSamplePerList)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sample vectors: %w", err)
+	}
+	centroids := vec.KMeans(slicez.Map(sample, func(f db.FragmentVector) []float64 { return f.Vector }), k, annIterations)
+
+	logger.Debug("assigning fragments to centroids")
+	assignments := map[int]int{}
+	for after := 0; ; {
+		page, err := cfg.Dao.FragmentVectors(cfg.ctx, model, after, annPageSize)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read vectors: %w", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, f := range page {
+			if nearest := vec.Nearest(centroids, f.Vector, 1); len(nearest) > 0 {
+				assignments[f.ID] = nearest[0]
+			}
+			after = f.ID
+		}
+	}
+
+	tx, err := cfg.db.BeginTx(cfg.ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	dao := cfg.Dao.WithTx(tx)
+
+	err = dao.DeleteCentroids(cfg.ctx, model)
+	if err != nil {
+		return 0, fmt.Errorf("failed to drop old index: %w", err)
+	}
+	ids := make([]int, len(centroids))
+	for i, c := range centroids {
+		ids[i], err = dao.AddCentroid(cfg.ctx, model, c)
+		if err != nil {
+			return 0, fmt.Errorf("failed to add centroid: %w", err)
+		}
+	}
+	for fragment, centroid := range assignments {
+		err = dao.AssignFragment(cfg.ctx, fragment, ids[centroid])
+		if err != nil {
+			return 0, fmt.Errorf("failed to assign fragment %d: %w", fragment, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit index: %w", err)
+	}
+	cfg.dropAnnIndex(model)
+
+	logger.Debug("built index", "fragments", len(assignments), "centroids", len(centroids))
+	return len(centroids), nil
+}
+
+// EnsureIndex builds the index of the embedding model in use, if there is none and there are enough fragments
+// for an index to pay off
+func EnsureIndex(cfg *Conf) error {
+	model := cfg.EmbedModel.String()
+	idx, err := cfg.annIndex(model)
+	if err != nil || idx != nil {
+		return err
+	}
+
+	n, err := cfg.Dao.CountFragments(cfg.ctx, model)
+	if err != nil {
+		return fmt.Errorf("failed to count fragments: %w", err)
+	}
+	if n < annMinFragments {
+		return nil
+	}
+
+	slog.Default().Info("building approximate nearest neighbour index", "fragments", n)
+	_, err = BuildIndex(cfg)
+	return err
+}
+
+// indexFragments lists newly added fragments under their closest centroid, if there is an index
+func indexFragments(cfg *Conf, dao *db.Queries, frags []db.Fragment) error {
+	for _, frag := range frags {
+		idx, err := cfg.annIndex(frag.EmbeddingModel)
+		if err != nil {
+			return err
+		}
+		if idx == nil {
+			continue
+		}
+		nearest := vec.Nearest(idx.vectors, frag.EmbeddingVector, 1)
+		if len(nearest) == 0 {
+			continue
+		}
+		err = dao.AssignFragment(cfg.ctx, frag.ID, idx.ids[nearest[0]])
+		if err != nil {
+			return fmt.Errorf("failed to index fragment %d: %w", frag.ID, err)
+		}
+	}
+	return nil
+}
+
+// knn finds the nearest fragments by probing the index, falling back to an exact search if there is no index,
+// if exact search is requested or if the probed lists does not hold enough fragments
+func knn(cfg *Conf, vector []float64, label string, limit int) ([]db.Fragment, error) {
+	if !cfg.exact {
+		idx, err := cfg.annIndex(cfg.EmbedModel.String())
+		if err != nil {
+			return nil, err
+		}
+		if idx != nil {
+			probes := slicez.Map(vec.Nearest(idx.vectors, vector, cfg.probes), func(i int) int { return idx.ids[i] })
+			frags, err := cfg.Dao.ANN(cfg.ctx, db.ANNParams{
+				Vector:    vector,
+				Label:     label,
+				Centroids: probes,
+				Metric:    cfg.metric,
+				Limit:     limit,
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(frags) >= limit {
+				return frags, nil
+			}
+			slog.Default().Debug("too few fragments in probed lists, falling back to exact search", "found", len(frags), "k", limit)
+		}
+	}
+	return cfg.Dao.KNN(cfg.ctx, db.KNNParams{
+		Vector:         vector,
+		EmbeddingModel: cfg.EmbedModel.String(),
+		Label:          label,
+		Metric:         cfg.metric,
+		Limit:          limit,
+	})
+}
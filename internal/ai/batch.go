@@ -0,0 +1,111 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/bellman/services/openai"
+	"io"
+	"net/http"
+	"sort"
+)
+
+type BatchRequest struct {
+	Ctx   context.Context
+	Model embed.Model
+	Texts []string
+}
+
+type BatchResponse struct {
+	// Embeddings are in the same order as the texts of the request
+	Embeddings [][]float64
+	Metadata   models.Metadata
+}
+
+// BatchEmbeder is implemented by embedders that can embed several texts in one request
+type BatchEmbeder interface {
+	EmbedBatch(req BatchRequest) (*BatchResponse, error)
+}
+
+// openAIBatch adds batch embedding to the bellman OpenAI client, which only embeds one text per request
+type openAIBatch struct {
+	*openai.OpenAI
+	key string
+}
+
+type openAIBatchRequest struct {
+	Model          string   `json:"model"`
+	Input          []string `json:"input"`
+	EncodingFormat string   `json:"encoding_format"`
+}
+
+type openAIBatchResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+func (o *openAIBatch) EmbedBatch(req BatchRequest) (*BatchResponse, error) {
+	body, err := json.Marshal(openAIBatchRequest{
+		Model:          req.Model.Name,
+		Input:          req.Texts,
+		EncodingFormat: "float",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal openai request, %w", err)
+	}
+
+	ctx := req.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create openai request, %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+o.key)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("could not post openai request, %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		d, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code, %d, %s", resp.StatusCode, string(d))
+	}
+
+	var respModel openAIBatchResponse
+	err = json.NewDecoder(resp.Body).Decode(&respModel)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode openai response, %w", err)
+	}
+	if len(respModel.Data) != len(req.Texts) {
+		return nil, fmt.Errorf("expected %d embeddings in response, got %d", len(req.Texts), len(respModel.Data))
+	}
+
+	sort.Slice(respModel.Data, func(i, j int) bool {
+		return respModel.Data[i].Index < respModel.Data[j].Index
+	})
+	res := &BatchResponse{
+		Metadata: models.Metadata{
+			Model:       req.Model.FQN(),
+			InputTokens: respModel.Usage.PromptTokens,
+			TotalTokens: respModel.Usage.TotalTokens,
+		},
+	}
+	for _, d := range respModel.Data {
+		res.Embeddings = append(res.Embeddings, d.Embedding)
+	}
+	return res, nil
+}
@@ -0,0 +1,62 @@
+package ai
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/embed"
+	"log/slog"
+)
+
+// EmbedCache stores embeddings by model, type and a hash of the embedded text, such that a text is only embedded
+// once per model. db.Queries implements it, persisting the embeddings in the knowledge base
+type EmbedCache interface {
+	// CachedEmbedding returns the cached vector, or sql.ErrNoRows if there is none
+	CachedEmbedding(ctx context.Context, model string, typ string, hash string) ([]float64, error)
+	CacheEmbedding(ctx context.Context, model string, typ string, hash string, vector []float64) error
+}
+
+// SetEmbedCache makes Embed look up texts in the cache before embedding them, and cache those it embeds
+func (p *Proxy) SetEmbedCache(cache EmbedCache) {
+	p.cache = cache
+}
+
+// contentHash identifies a text in the cache
+func contentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedEmbed returns the cached embedding of the request, or embeds and caches it. A failing cache is logged
+// rather than failing the request, since the text can always be embedded
+func (p *Proxy) cachedEmbed(req embed.Request) (*embed.Response, error) {
+	ctx := req.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	model := req.Model.FQN()
+	typ := string(req.Model.Type)
+	hash := contentHash(req.Text)
+
+	vector, err := p.cache.CachedEmbedding(ctx, model, typ, hash)
+	if err == nil {
+		slog.Default().Debug("embedding cache hit", "model", model, "type", typ, "hash", hash)
+		return &embed.Response{Embedding: vector, Metadata: models.Metadata{Model: model}}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		slog.Default().Warn("failed to read embedding cache", "model", model, "err", err)
+	}
+
+	resp, err := p.embed(req)
+	if err != nil {
+		return nil, err
+	}
+	err = p.cache.CacheEmbedding(ctx, model, typ, hash, resp.Embedding)
+	if err != nil {
+		slog.Default().Warn("failed to write embedding cache", "model", model, "err", err)
+	}
+	return resp, nil
+}
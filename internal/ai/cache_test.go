@@ -0,0 +1,62 @@
+package ai
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/modfin/bellman/models/embed"
+)
+
+func TestEmbedCache(t *testing.T) {
+	cfg := testConf(t)
+	f := &failing{failures: 0}
+	cfg.Proxy.RegisterEmbeder(f)
+	cfg.Proxy.SetEmbedCache(cfg.Dao)
+
+	embedText := func(typ embed.Type, text string) []float64 {
+		model := embed.Model{Provider: "Failing", Name: "embed"}.WithType(typ)
+		res, err := cfg.Proxy.Embed(embed.Request{Ctx: context.Background(), Model: model, Text: text})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return res.Embedding
+	}
+
+	a := embedText(embed.TypeQuery, "how many vacation days?")
+	b := embedText(embed.TypeQuery, "how many vacation days?")
+	if f.calls != 1 {
+		t.Errorf("Expected the second embedding to be cached, got %d calls", f.calls)
+	}
+	// cached vectors are stored as float32
+	if len(a) != len(b) {
+		t.Fatalf("Expected %d dimensions, got %d", len(a), len(b))
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-6 {
+			t.Fatalf("Expected the cached embedding to equal the embedded one, got %v and %v", a, b)
+		}
+	}
+
+	embedText(embed.TypeDocument, "how many vacation days?")
+	embedText(embed.TypeQuery, "is remote work allowed?")
+	if f.calls != 3 {
+		t.Errorf("Expected other types and texts to be embedded, got %d calls", f.calls)
+	}
+
+	stats, err := cfg.Dao.EmbeddingCacheStats(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Entries != 3 {
+		t.Errorf("Expected 3 cached embeddings of one model, got %v", stats)
+	}
+
+	deleted, err := cfg.Dao.ClearEmbeddingCache(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("Expected 3 deleted embeddings, got %d", deleted)
+	}
+}
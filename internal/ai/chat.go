@@ -0,0 +1,218 @@
+package ai
+
+import (
+	"fmt"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/henry/slicez"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// chatHistoryTurns is the number of previous turns that is given to the llm, to bound the size of the prompt
+const chatHistoryTurns = 10
+
+type Turn struct {
+	Question string
+	// Query is the standalone question that fragments were retrieved with
+	Query  string
+	Answer Answer
+	// Fragments are the ids of the fragments that was retrieved for the question
+	Fragments []int
+}
+
+// Conversation is a chat with the knowledge base, where every question is answered in the light of the previous turns
+type Conversation struct {
+	Turns []Turn
+	// Session is the name of the session the turns are persisted in, if any
+	Session   string
+	sessionID int
+}
+
+// OpenSession continues the named session from the database, creating it if it does not exist
+func OpenSession(cfg *Conf, name string) (*Conversation, error) {
+	if name == "" {
+		return nil, fmt.Errorf("expected a session name")
+	}
+	session, err := cfg.Dao.CreateSession(cfg.ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session %s: %w", name, err)
+	}
+	turns, err := cfg.Dao.SessionTurns(cfg.ctx, session.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read turns of session %s: %w", name, err)
+	}
+
+	return &Conversation{
+		Session:   session.Name,
+		sessionID: session.ID,
+		Turns: slicez.Map(turns, func(t db.SessionTurn) Turn {
+			return Turn{
+				Question: t.Question,
+				Query:    t.Query,
+				Answer: Answer{
+					Answer:          t.Answer,
+					ConfidenceScore: float32(t.Confidence),
+					Sources:         t.Sources,
+					Metadata: models.Metadata{
+						Model:        t.LLMModel,
+						InputTokens:  t.InputTokens,
+						OutputTokens: t.OutputTokens,
+						TotalTokens:  t.TotalTokens,
+					},
+				},
+				Fragments: t.FragmentIDs,
+			}
+		}),
+	}, nil
+}
+
+// DeleteSession deletes the named session and its turns, reporting whether there was such a session
+func DeleteSession(cfg *Conf, name string) (bool, error) {
+	if name == "" {
+		return false, fmt.Errorf("expected a session name")
+	}
+
+	tx, err := cfg.db.BeginTx(cfg.ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	deleted, err := cfg.Dao.WithTx(tx).DeleteSession(cfg.ctx, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete session %s: %w", name, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("failed to commit deletion of session %s: %w", name, err)
+	}
+	return deleted, nil
+}
+
+// Ask answers a question of the conversation, rewritten into a standalone question to retrieve fragments with
+func (c *Conversation) Ask(cfg *Conf, question string) (Answer, error) {
+	return c.ask(cfg, question, func(fragments []db.Fragment, history []prompt.Prompt) (Answer, error) {
+		return answer(cfg, question, fragments, history)
+	})
+}
+
+// AskStream answers a question of the conversation like Ask, but writes the answer to w as it is generated
+func (c *Conversation) AskStream(cfg *Conf, question string, w io.Writer) (Answer, error) {
+	return c.ask(cfg, question, func(fragments []db.Fragment, history []prompt.Prompt) (Answer, error) {
+		return streamAnswer(cfg, question, fragments, history, w)
+	})
+}
+
+func (c *Conversation) ask(cfg *Conf, question string, respond func(fragments []db.Fragment, history []prompt.Prompt) (Answer, error)) (Answer, error) {
+	query := question
+	if len(c.Turns) > 0 {
+		var err error
+		query, err = standaloneQuestion(cfg, c.recent(), question)
+		if err != nil {
+			slog.Default().Warn("failed to rewrite follow up question, retrieving with it as is", "err", err)
+			query = question
+		}
+		slog.Default().Debug("rewrote follow up question", "question", question, "query", query)
+	}
+
+	fragments, err := Search(cfg, query)
+	if err != nil {
+		return Answer{}, fmt.Errorf("failed to Search: %w", err)
+	}
+
+	history := slicez.FlatMap(c.recent(), func(t Turn) []prompt.Prompt {
+		return []prompt.Prompt{
+			prompt.AsUser(fmt.Sprintf("<user-question> %s </user-question>", t.Question)),
+			prompt.AsAssistant(t.Answer.Answer),
+		}
+	})
+	ans, err := respond(fragments, history)
+	if err != nil {
+		return Answer{}, err
+	}
+
+	turn := Turn{
+		Question: question,
+		Query:    query,
+		Answer:   ans,
+		Fragments: slicez.Map(fragments, func(f db.Fragment) int {
+			return f.ID
+		}),
+	}
+	if c.sessionID != 0 {
+		err = cfg.Dao.AddSessionTurn(cfg.ctx, db.AddSessionTurnParams{
+			SessionID:    c.sessionID,
+			Question:     turn.Question,
+			Query:        turn.Query,
+			Answer:       ans.Answer,
+			Confidence:   float64(ans.ConfidenceScore),
+			Sources:      ans.Sources,
+			FragmentIDs:  turn.Fragments,
+			LLMModel:     ans.Metadata.Model,
+			InputTokens:  ans.Metadata.InputTokens,
+			OutputTokens: ans.Metadata.OutputTokens,
+			TotalTokens:  ans.Metadata.TotalTokens,
+		})
+		if err != nil {
+			return Answer{}, fmt.Errorf("failed to save turn to session %s: %w", c.Session, err)
+		}
+	}
+
+	c.Turns = append(c.Turns, turn)
+	return ans, nil
+}
+
+// Reset forgets the previous turns, also in the session if the conversation is persisted
+func (c *Conversation) Reset(cfg *Conf) error {
+	if c.sessionID != 0 {
+		err := cfg.Dao.ClearSession(cfg.ctx, c.sessionID)
+		if err != nil {
+			return fmt.Errorf("failed to clear session %s: %w", c.Session, err)
+		}
+	}
+	c.Turns = nil
+	return nil
+}
+
+func (c *Conversation) recent() []Turn {
+	return c.Turns[max(0, len(c.Turns)-chatHistoryTurns):]
+}
+
+const standaloneSystemPrompt = `You rewrite the follow up question of a conversation into a standalone question, which can be understood
+without the conversation, by replacing references such as "it" or "that" with what they refer to.
+Keep the language of the question. Only output the rewritten question. If the question already stands alone, output it as is.`
+
+func standaloneQuestion(cfg *Conf, turns []Turn, question string) (string, error) {
+	llm, err := cfg.Proxy.Gen(cfg.LLMModel, cfg.llmFallbacks...)
+	if err != nil {
+		return "", fmt.Errorf("failed to create llm: %w", err)
+	}
+
+	var conversation strings.Builder
+	for _, t := range turns {
+		fmt.Fprintf(&conversation, "User: %s\nAssistant: %s\n", t.Question, t.Answer.Answer)
+	}
+
+	res, err := llm.
+		WithContext(cfg.ctx).
+		System(standaloneSystemPrompt).
+		Prompt(prompt.AsUser(fmt.Sprintf("<conversation>\n%s</conversation>\n<follow-up-question> %s </follow-up-question>",
+			conversation.String(), question)))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate response: %w", err)
+	}
+
+	text, err := res.AsText()
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return question, nil
+	}
+	return text, nil
+}
@@ -0,0 +1,35 @@
+package ai
+
+import (
+	"testing"
+)
+
+func TestDeleteSession(t *testing.T) {
+	cfg := testConf(t)
+
+	conv, err := OpenSession(cfg, "onboarding")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = conv.Ask(cfg, "how many vacation days do I get per year?")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	deleted, err := DeleteSession(cfg, "onboarding")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !deleted {
+		t.Errorf("Expected the session to be deleted")
+	}
+
+	// opening the session again starts it over
+	conv, err = OpenSession(cfg, "onboarding")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(conv.Turns) != 0 {
+		t.Errorf("Expected the turns to be deleted with the session, got %d", len(conv.Turns))
+	}
+}
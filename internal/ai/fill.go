@@ -0,0 +1,373 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/henry/slicez"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fill answers every row of the input file, writing it with answer, confidence_score and sources to the output file
+func Fill(cfg *Conf) (err error) {
+
+	if cfg.Proxy.budget > 0 {
+		models := []string{cfg.EmbedModel.String(), cfg.LLMModel.FQN()}
+		for _, m := range cfg.llmFallbacks {
+			models = append(models, m.FQN())
+		}
+		for _, m := range models {
+			if !cfg.Proxy.Priced(m) {
+				slog.Default().Warn("model has no price, its cost is not counted towards the budget", "model", m)
+			}
+		}
+	}
+
+	in, err := os.Open(cfg.in)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer in.Close()
+
+	delimiter := cfg.delimiter
+	if len(delimiter) == 0 {
+		delimiter = "\t"
+	}
+
+	csvin := csv.NewReader(in)
+	csvin.LazyQuotes = true
+	switch delimiter {
+	case "\\t":
+		csvin.Comma = '\t'
+	default:
+		csvin.Comma = rune(delimiter[0])
+	}
+
+	var previous [][]string
+	var retry map[int]bool
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	outFile := cfg.out
+	if cfg.resume {
+		previous, err = readRows(cfg.out, csvin.Comma)
+		if err != nil {
+			return fmt.Errorf("failed to resume from output file: %w", err)
+		}
+		retry, err = failedRows(cfg.out+".errors", previous)
+		if err != nil {
+			return fmt.Errorf("failed to read error file: %w", err)
+		}
+		// failed rows are answered again in place, so the output is rewritten to a temporary file which replaces
+		// the output once done. Otherwise new rows are appended
+		if len(retry) == 0 {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		} else {
+			outFile = cfg.out + ".tmp"
+		}
+		slog.Default().Info("resuming fill", "rows-done", len(previous), "rows-failed", len(retry))
+	}
+	done := len(previous)
+
+	out, err := os.OpenFile(outFile, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer out.Close()
+
+	csvout := csv.NewWriter(out)
+	csvout.Comma = csvin.Comma
+	defer csvout.Flush()
+
+	var errlog *os.File
+	defer func() {
+		if errlog != nil {
+			errlog.Close()
+		}
+	}()
+	logError := func(row int, rowErr error) error {
+		if errlog == nil {
+			f, err := os.OpenFile(cfg.out+".errors", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to open error file: %w", err)
+			}
+			errlog = f
+		}
+		_, err := fmt.Fprintf(errlog, "%d\t%s\n", row, strings.ReplaceAll(rowErr.Error(), "\n", " "))
+		return err
+	}
+
+	var headers []string
+	row := 1
+	if cfg.withHeaders {
+		record, err := csvin.Read()
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read headers: %w", err)
+		}
+		headers = append([]string{}, record...)
+		if done < 1 && record != nil {
+			err = csvout.Write(append(record, "answer", "confidence_score", "sources"))
+			if err != nil {
+				return err
+			}
+		}
+		row++
+	}
+
+	// the first row to be written, the rows before it are either headers or already written
+	next := max(row, done+1)
+
+	// copyPrevious writes the rows of the previous output, up to the next failed row or all of them, when the
+	// output is rewritten
+	copyPrevious := func(all bool) error {
+		for ; next <= done && (all || !retry[next]); next++ {
+			err := csvout.Write(previous[next-1])
+			if err != nil {
+				return fmt.Errorf("failed to write row: %w", err)
+			}
+		}
+		csvout.Flush()
+		return csvout.Error()
+	}
+	if len(retry) > 0 {
+		next = 1
+		err = copyPrevious(false)
+		if err != nil {
+			return err
+		}
+		// the output is replaced also when aborted, keeping the rows answered again so far
+		defer func() {
+			rerr := copyPrevious(true)
+			if rerr == nil {
+				rerr = out.Close()
+			}
+			if rerr == nil {
+				rerr = os.Rename(outFile, cfg.out)
+			}
+			if rerr != nil && err == nil {
+				err = fmt.Errorf("failed to replace output file: %w", rerr)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(cfg.ctx)
+	defer cancel()
+	wcfg := cfg.WithContext(ctx)
+
+	// rows are read in order and answered concurrently, results are then put back in order before being written
+	jobs := make(chan fillJob)
+	go func() {
+		defer close(jobs)
+		for ; ; row++ {
+			record, err := csvin.Read()
+			if err == io.EOF {
+				return
+			}
+			if row <= done && !retry[row] {
+				continue
+			}
+			select {
+			case jobs <- fillJob{row: row, record: record}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	results := make(chan fillResult)
+	var wg sync.WaitGroup
+	for range max(cfg.concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				start := time.Now()
+				answer, err := FillRow(wcfg, headers, job.record)
+				select {
+				case results <- fillResult{fillJob: job, answer: answer, err: err, took: time.Since(start)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var inputTokens int
+	var outputTokens int
+	var failed int
+
+	pending := map[int]fillResult{}
+	for res := range results {
+		pending[res.row] = res
+
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+
+			// next is advanced once the row is written, so an aborted row is copied from the previous output
+			if res.err != nil {
+				if errors.Is(res.err, ErrBudgetExceeded) {
+					return fmt.Errorf("aborted at row %d, rerun with --resume to continue: %w", res.row, res.err)
+				}
+				if !cfg.keepGoing {
+					return fmt.Errorf("failed to Query row %d: %w", res.row, res.err)
+				}
+				failed++
+				slog.Default().Warn("failed to answer row, keeping going", "row", res.row, "err", res.err)
+				err = logError(res.row, res.err)
+				if err != nil {
+					return err
+				}
+				err = csvout.Write(append(res.record, "", "", ""))
+				if err != nil {
+					return fmt.Errorf("failed to write row: %w", err)
+				}
+				next++
+				err = copyPrevious(false)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			answer := res.answer
+			inputTokens += answer.Metadata.InputTokens
+			outputTokens += answer.Metadata.OutputTokens
+			err = csvout.Write(append(res.record, answer.Answer, fmt.Sprintf("%.3f", answer.ConfidenceScore), citationNames(answer)))
+			if err != nil {
+				return fmt.Errorf("failed to write row: %w", err)
+			}
+			next++
+			err = copyPrevious(false)
+			if err != nil {
+				return err
+			}
+
+			slog.Default().Debug("Fill",
+				"row", res.row,
+				"confidence", answer.ConfidenceScore,
+				"took", res.took,
+				"input-tokens", answer.Metadata.InputTokens,
+				"output-tokens", answer.Metadata.OutputTokens,
+				"input-tokens-total", inputTokens,
+				"output-tokens-total", outputTokens,
+				"cost-total", cfg.Proxy.Spent(),
+			)
+		}
+	}
+
+	if failed > 0 {
+		slog.Default().Warn("some rows could not be answered", "failed", failed, "errors", cfg.out+".errors")
+	}
+
+	return csvout.Error()
+
+}
+
+type fillJob struct {
+	row    int
+	record []string
+}
+
+type fillResult struct {
+	fillJob
+	answer Answer
+	err    error
+	took   time.Duration
+}
+
+// readRows reads the rows of a previous output file, where a file that does not end with a newline was cut short
+func readRows(file string, comma rune) ([][]string, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		return nil, fmt.Errorf("%s ends with a partially written row, remove it before resuming", file)
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = comma
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+
+	var rows [][]string
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row %d of %s: %w", len(rows)+1, file, err)
+		}
+		rows = append(rows, record)
+	}
+}
+
+// failedRows are the rows recorded in the error file that are still without answer in the previous output
+func failedRows(errorsFile string, previous [][]string) (map[int]bool, error) {
+	data, err := os.ReadFile(errorsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	failed := map[int]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		row, err := strconv.Atoi(strings.SplitN(line, "\t", 2)[0])
+		if err != nil || row < 1 || row > len(previous) {
+			continue
+		}
+		record := previous[row-1]
+		if len(record) >= 3 && record[len(record)-3] == "" {
+			failed[row] = true
+		}
+	}
+	return failed, nil
+}
+
+// citationNames joins the names of the fragments cited by an answer, for a single csv column
+func citationNames(ans Answer) string {
+	return strings.Join(slicez.Map(ans.Citations, func(f db.Fragment) string {
+		return f.Name
+	}), "; ")
+}
+
+// FillRow answers the question posed by a row, where each column is tagged with its header
+func FillRow(cfg *Conf, headers []string, record []string) (Answer, error) {
+	getName := func(col int) string {
+		if len(headers) > col {
+			return headers[col]
+		}
+		return fmt.Sprintf("col_%d", col)
+	}
+
+	var col int
+	cols := slicez.Map(record, func(s string) string {
+		name := getName(col)
+		col += 1
+		return fmt.Sprintf("<%s>\n  %s\n</%s>", name, s, name)
+	})
+
+	return Query(cfg, strings.Join(cols, "\n"))
+}
@@ -0,0 +1,109 @@
+package ai
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/models/gen"
+)
+
+func TestFillResumeRetriesFailedRows(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepGoing bool
+		llm       gen.Gen
+		err       string
+		want      [][]string
+	}{
+		{
+			name:      "answered again",
+			keepGoing: true,
+			want: [][]string{
+				{"question", "answer", "sources"},
+				{"how many vacation days per year?", testDocuments[1].Content, "vacation.md"},
+				{"is remote work allowed?", "previous answer", "remote.md"},
+				{"when does the office open?", testDocuments[2].Content, "office.md"},
+			},
+		},
+		{
+			// the row that fails again is kept in place, so the rows after it are not moved up
+			name: "failing again without keep going",
+			llm:  &failing{status: 400, failures: -1},
+			err:  "failed to Query row 2",
+			want: [][]string{
+				{"question", "answer", "sources"},
+				{"how many vacation days per year?", "", ""},
+				{"is remote work allowed?", "previous answer", "remote.md"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConf(t).WithLimits(ParseLimits([]string{"3"}))
+			if tt.llm != nil {
+				cfg.Proxy.RegisterGen(tt.llm)
+				cfg = cfg.WithLLMModel(gen.Model{Provider: tt.llm.Provider(), Name: "llm"})
+			}
+
+			dir := t.TempDir()
+			cfg.in = filepath.Join(dir, "in.csv")
+			cfg.out = filepath.Join(dir, "out.csv")
+			cfg.delimiter = ","
+			cfg.withHeaders = true
+			cfg.resume = true
+			cfg.keepGoing = tt.keepGoing
+			err := os.WriteFile(cfg.in, []byte("question\nhow many vacation days per year?\nis remote work allowed?\nwhen does the office open?\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a previous fill failed the first row and answered the second
+			err = os.WriteFile(cfg.out, []byte("question,answer,confidence_score,sources\n"+
+				"how many vacation days per year?,,,\n"+
+				"is remote work allowed?,previous answer,0.900,remote.md\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(cfg.out+".errors", []byte("2\tunexpected status code, 503\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = Fill(cfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Expected an error containing %q, got %v", tt.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			f, err := os.Open(cfg.out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			rows, err := csv.NewReader(f).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rows) != len(tt.want) {
+				t.Fatalf("Expected %d rows, got %d: %v", len(tt.want), len(rows), rows)
+			}
+			for i, row := range rows {
+				got := []string{row[0], row[1], row[3]}
+				if !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("Row %d: expected %v, got %v", i, tt.want[i], got)
+				}
+			}
+			if _, err := os.Stat(cfg.out + ".tmp"); err == nil {
+				t.Errorf("Expected the rewritten output to replace the output file")
+			}
+		})
+	}
+}
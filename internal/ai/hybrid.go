@@ -0,0 +1,43 @@
+package ai
+
+import (
+	"github.com/modfin/blot/internal/db"
+	"sort"
+)
+
+type SearchMode string
+
+const (
+	ModeVector  SearchMode = "vector"
+	ModeLexical SearchMode = "lexical"
+	ModeHybrid  SearchMode = "hybrid"
+)
+
+// hybridCandidates is how many times more fragments than the limit that are fetched from each ranking before fusion
+const hybridCandidates = 4
+
+// rrfK dampens the impact of the top ranks in reciprocal rank fusion, 60 is the constant used in the original paper
+const rrfK = 60
+
+// fuse merges rankings using reciprocal rank fusion, scoring each fragment by the sum of 1/(k + rank)
+func fuse(rankings ...[]db.Fragment) []db.Fragment {
+	scores := map[int]float64{}
+	var fused []db.Fragment
+
+	for _, ranking := range rankings {
+		for rank, frag := range ranking {
+			if _, seen := scores[frag.ID]; !seen {
+				fused = append(fused, frag)
+			}
+			scores[frag.ID] += 1 / float64(rrfK+rank+1)
+		}
+	}
+
+	for i := range fused {
+		fused[i].Score = scores[fused[i].ID]
+	}
+	sort.SliceStable(fused, func(i, j int) bool {
+		return fused[i].Score > fused[j].Score
+	})
+	return fused
+}
@@ -0,0 +1,54 @@
+package ai
+
+import (
+	"fmt"
+	"github.com/modfin/blot/internal/db/vec"
+	"log/slog"
+)
+
+// searchMetric is the metric asked for, or otherwise the one recorded for the embedding model
+func searchMetric(cfg *Conf) (vec.Metric, error) {
+	model := cfg.EmbedModel.String()
+	recorded, err := cfg.Dao.Metric(cfg.ctx, model)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up distance metric of %s: %w", model, err)
+	}
+
+	switch {
+	case cfg.metric == "" && recorded == "":
+		return vec.DefaultMetric, nil
+	case cfg.metric == "":
+		return recorded, nil
+	case recorded != "" && cfg.metric != recorded:
+		slog.Default().Warn("searching with another distance metric than the one recorded for the embedding model",
+			"embed-model", model, "metric", cfg.metric, "recorded", recorded)
+	}
+	return cfg.metric, nil
+}
+
+// recordMetric records the metric of the embedding model, and refuses another metric than the recorded one
+func recordMetric(cfg *Conf) error {
+	model := cfg.EmbedModel.String()
+	recorded, err := cfg.Dao.Metric(cfg.ctx, model)
+	if err != nil {
+		return fmt.Errorf("failed to look up distance metric of %s: %w", model, err)
+	}
+
+	if recorded != "" {
+		if cfg.metric != "" && cfg.metric != recorded {
+			return fmt.Errorf("the knowledge base uses the distance metric %s for %s, not %s", recorded, model, cfg.metric)
+		}
+		return nil
+	}
+
+	metric := cfg.metric
+	if metric == "" {
+		metric = vec.DefaultMetric
+	}
+	err = cfg.Dao.SetMetric(cfg.ctx, model, metric)
+	if err != nil {
+		return fmt.Errorf("failed to record distance metric of %s: %w", model, err)
+	}
+	slog.Default().Debug("recorded distance metric", "embed-model", model, "metric", metric)
+	return nil
+}
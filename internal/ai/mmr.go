@@ -0,0 +1,74 @@
+package ai
+
+import (
+	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/blot/internal/db/vec"
+	"github.com/modfin/henry/slicez"
+	"math"
+)
+
+// mmrCandidates is how many times more fragments than the limit that are retrieved to diversify among
+const mmrCandidates = 4
+
+// mmr selects limit fragments by maximal marginal relevance, where a lambda of 1 keeps them in order of relevance
+func mmr(frags []db.Fragment, lambda float64, limit int) []db.Fragment {
+	if lambda >= 1 || len(frags) <= 1 {
+		return slicez.Take(frags, limit)
+	}
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, f := range frags {
+		lo = min(lo, f.Score)
+		hi = max(hi, f.Score)
+	}
+	relevance := make([]float64, len(frags))
+	vectors := make([][]float64, len(frags))
+	for i, f := range frags {
+		relevance[i] = 1
+		if hi > lo {
+			relevance[i] = (f.Score - lo) / (hi - lo)
+		}
+		vectors[i] = vec.Normalize(f.EmbeddingVector)
+	}
+
+	// similarity to the closest selected fragment, for every candidate
+	similarity := make([]float64, len(frags))
+	for i := range similarity {
+		similarity[i] = math.Inf(-1)
+	}
+	picked := make([]bool, len(frags))
+
+	var selected []db.Fragment
+	for len(selected) < min(limit, len(frags)) {
+		best, bestValue := -1, math.Inf(-1)
+		for i := range frags {
+			if picked[i] {
+				continue
+			}
+			value := lambda * relevance[i]
+			if len(selected) > 0 {
+				value -= (1 - lambda) * similarity[i]
+			}
+			if value > bestValue {
+				best, bestValue = i, value
+			}
+		}
+
+		picked[best] = true
+		selected = append(selected, frags[best])
+		for i := range frags {
+			if !picked[i] {
+				similarity[i] = max(similarity[i], dot(vectors[i], vectors[best]))
+			}
+		}
+	}
+	return selected
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := 0; i < min(len(a), len(b)); i++ {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
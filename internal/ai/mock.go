@@ -0,0 +1,274 @@
+package ai
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/schema"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// MockProvider is a built-in provider that needs no network, for tests and offline development. Its embeddings
+// are deterministic hashes of the words of a text, such that texts sharing words are similar, and its answers are
+// templated from the documents and question of the prompt
+const MockProvider = "Mock"
+
+// mockDimensions is the number of dimensions of mock embeddings
+const mockDimensions = 64
+
+type mock struct{}
+
+func (m *mock) Provider() string {
+	return MockProvider
+}
+
+// Embed hashes every word of the text to a dimension, seeded by the model name so that different mock models
+// embed into different vector spaces
+func (m *mock) Embed(req embed.Request) (*embed.Response, error) {
+	words := mockWords(req.Text)
+	v := make([]float64, mockDimensions)
+	for _, w := range words {
+		h := fnv.New64a()
+		h.Write([]byte(req.Model.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(w))
+		sum := h.Sum64()
+		sign := 1.0
+		if sum&1 == 1 {
+			sign = -1
+		}
+		v[(sum>>1)%mockDimensions] += sign
+	}
+
+	var norm float64
+	for _, f := range v {
+		norm += f * f
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		v[0], norm = 1, 1 // a text without words still has a direction
+	}
+	for i := range v {
+		v[i] /= norm
+	}
+
+	return &embed.Response{
+		Embedding: v,
+		Metadata: models.Metadata{
+			Model:       req.Model.FQN(),
+			InputTokens: len(words),
+			TotalTokens: len(words),
+		},
+	}, nil
+}
+
+func (m *mock) Generator(options ...gen.Option) *gen.Generator {
+	g := &gen.Generator{Prompter: &mockPrompter{}}
+	for _, op := range options {
+		g = op(g)
+	}
+	return g
+}
+
+type mockPrompter struct {
+	request gen.Request
+}
+
+func (p *mockPrompter) SetRequest(request gen.Request) {
+	p.request = request
+}
+
+var (
+	// documents of answers are labeled and named, eg. <QA-document id="1" name="..">, while those of reranking are not
+	mockDocumentPattern = regexp.MustCompile(`(?s)<(?:[^>\s]*-)?document id="(\d+)"(?: name="([^"]*)")?[^>]*>(.*?)</(?:[^>\s]*-)?document>`)
+	mockQuestionPattern = regexp.MustCompile(`(?s)<(user|follow-up)-question>(.*)</(?:user|follow-up)-question>`)
+)
+
+type mockDocument struct {
+	id      int
+	name    string
+	content string
+}
+
+// Prompt answers with the content of the document sharing the most words with the question, citing it. Structured
+// output is generated from the schema, where properties are filled by their name, eg. answer, sources and
+// confidence_score, or otherwise by their type
+func (p *mockPrompter) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
+	var docs []mockDocument
+	var question string
+	var followUp bool
+	var input int
+	for _, pr := range prompts {
+		input += len(mockWords(pr.Text))
+		if ms := mockDocumentPattern.FindAllStringSubmatch(pr.Text, -1); ms != nil {
+			for _, m := range ms {
+				id, _ := strconv.Atoi(m[1])
+				docs = append(docs, mockDocument{id: id, name: m[2], content: strings.TrimSpace(m[3])})
+			}
+			continue
+		}
+		if m := mockQuestionPattern.FindStringSubmatch(pr.Text); m != nil {
+			question = strings.TrimSpace(m[2])
+			followUp = m[1] == "follow-up"
+		}
+	}
+	input += len(mockWords(p.request.SystemPrompt))
+
+	a := mockAnswer(question, docs)
+
+	var text string
+	switch {
+	case p.request.OutputSchema != nil:
+		data, err := json.Marshal(a.value(p.request.OutputSchema, ""))
+		if err != nil {
+			return nil, fmt.Errorf("mock could not marshal output, %w", err)
+		}
+		text = string(data)
+	case strings.Contains(p.request.SystemPrompt, "<"+answerMetadataTag+">"):
+		metadata, _ := json.Marshal(map[string]any{"confidence_score": a.confidence, "sources": a.sources})
+		text = fmt.Sprintf("%s\n<%s>%s</%s>", a.answer, answerMetadataTag, metadata, answerMetadataTag)
+	case followUp:
+		text = question // the mock leaves follow up questions as they are, rather than rewriting them
+	default:
+		text = a.answer
+	}
+
+	output := len(mockWords(text))
+	return &gen.Response{
+		Texts: []string{text},
+		Metadata: models.Metadata{
+			Model:        p.request.Model.FQN(),
+			InputTokens:  input,
+			OutputTokens: output,
+			TotalTokens:  input + output,
+		},
+	}, nil
+}
+
+type mockAnswered struct {
+	answer     string
+	confidence float64
+	sources    []int
+	docs       []mockDocument
+	relevance  map[int]float64
+}
+
+func mockAnswer(question string, docs []mockDocument) mockAnswered {
+	a := mockAnswered{docs: docs, relevance: map[int]float64{}, sources: []int{}}
+
+	asked := map[string]bool{}
+	for _, w := range mockWords(question) {
+		asked[w] = true
+	}
+	best := -1
+	for i, doc := range docs {
+		words := mockWords(doc.content)
+		var shared int
+		for _, w := range words {
+			// short words, such as "is" or "the", says little about what the document is about
+			if len(w) > 3 && asked[w] {
+				shared++
+			}
+		}
+		if len(words) > 0 {
+			a.relevance[doc.id] = float64(shared) / float64(len(words))
+		}
+		if best < 0 || a.relevance[doc.id] > a.relevance[docs[best].id] {
+			best = i
+		}
+	}
+
+	if best < 0 || a.relevance[docs[best].id] == 0 {
+		a.answer = "I do not know, no document answers the question."
+		return a
+	}
+	a.answer = docs[best].content
+	a.confidence = math.Round(a.relevance[docs[best].id]*100) / 100
+	a.sources = []int{docs[best].id}
+	return a
+}
+
+// value generates a value following the schema, for the property of the name
+func (a mockAnswered) value(s *schema.JSON, name string) any {
+	switch s.Type {
+	case schema.Object:
+		obj := map[string]any{}
+		for prop, ps := range s.Properties {
+			obj[prop] = a.value(ps, prop)
+		}
+		return obj
+
+	case schema.Array:
+		if name == "sources" {
+			return a.sources
+		}
+		// one item per document, eg. the grades of the documents when reranking
+		items := []any{}
+		if s.Items != nil && s.Items.Type == schema.Object {
+			sorted := append([]mockDocument{}, a.docs...)
+			sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].id < sorted[j].id })
+			for _, doc := range sorted {
+				item := map[string]any{}
+				for prop, ps := range s.Items.Properties {
+					switch {
+					case prop == "id":
+						item[prop] = doc.id
+					case ps.Type == schema.Number || ps.Type == schema.Integer:
+						item[prop] = mockScale(ps, a.relevance[doc.id])
+					default:
+						item[prop] = a.value(ps, prop)
+					}
+				}
+				items = append(items, item)
+			}
+		}
+		return items
+
+	case schema.Number, schema.Integer:
+		if name == "confidence_score" {
+			return a.confidence
+		}
+		return mockScale(s, 0)
+
+	case schema.Boolean:
+		return a.confidence > 0
+
+	default:
+		if len(s.Enum) > 0 {
+			return s.Enum[0]
+		}
+		return a.answer
+	}
+}
+
+// mockScale maps a relevance in [0, 1] onto the range of the schema, if it has one
+func mockScale(s *schema.JSON, relevance float64) any {
+	lo, hi := 0.0, 1.0
+	if s.Minimum != nil {
+		lo = *s.Minimum
+	}
+	if s.Maximum != nil {
+		hi = *s.Maximum
+	}
+	v := lo + relevance*(hi-lo)
+	if s.Type == schema.Integer {
+		return int(math.Round(v))
+	}
+	return math.Round(v*100) / 100
+}
+
+// mockWords splits a text into lower case words, ignoring punctuation and markup
+func mockWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
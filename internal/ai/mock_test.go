@@ -0,0 +1,218 @@
+package ai
+
+import (
+	"context"
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/blot/internal/chunk"
+	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/blot/internal/db/vec"
+)
+
+var testDocuments = []Document{
+	{Label: "policies", Name: "remote.md", Content: "Remote work is allowed two days a week for all employees."},
+	{Label: "policies", Name: "vacation.md", Content: "Vacation is twenty five days per year, planned with your manager."},
+	{Label: "facilities", Name: "office.md", Content: "The office opens at eight in the morning and closes at six."},
+}
+
+// testConf creates a knowledge base of the test documents, using the mock provider, with the same defaults as LoadConf
+func testConf(t *testing.T) *Conf {
+	t.Helper()
+	ctx := context.Background()
+
+	conn, err := db.Open(ctx, filepath.Join(t.TempDir(), "blot.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	proxy := newProxy()
+	proxy.RegisterGen(&mock{})
+	proxy.RegisterEmbeder(&mock{})
+
+	cfg := &Conf{
+		ctx:              ctx,
+		db:               conn,
+		Dao:              db.New(conn),
+		Proxy:            proxy,
+		EmbedModel:       embed.Model{Provider: MockProvider, Name: "embed"},
+		LLMModel:         gen.Model{Provider: MockProvider, Name: "llm"},
+		limits:           map[string]int{"%": 1},
+		mode:             ModeVector,
+		probes:           8,
+		ann:              &annCache{indexes: map[string]*annIndex{}},
+		encoding:         vec.DefaultEncoding,
+		minScore:         math.Inf(-1),
+		rerankCandidates: defaultRerankCandidates,
+		mmrLambda:        1,
+		chunking:         chunk.Options{Strategy: chunk.None},
+		batchSize:        defaultEmbedBatchSize,
+		batchTokens:      defaultEmbedBatchTokens,
+		concurrency:      1,
+	}
+
+	_, err = AddDocuments(cfg, testDocuments)
+	if err != nil {
+		t.Fatalf("Failed to add documents: %v", err)
+	}
+	return cfg
+}
+
+func TestMockEmbedIsDeterministic(t *testing.T) {
+	m := &mock{}
+	embedText := func(model, text string) []float64 {
+		res, err := m.Embed(embed.Request{Model: embed.Model{Provider: MockProvider, Name: model}, Text: text})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return res.Embedding
+	}
+
+	a := embedText("embed", "Remote work, two days a week")
+	if !reflect.DeepEqual(a, embedText("embed", "remote WORK two days a week")) {
+		t.Errorf("Expected the same embedding regardless of case and punctuation")
+	}
+	if reflect.DeepEqual(a, embedText("other", "remote work two days a week")) {
+		t.Errorf("Expected different models to embed differently")
+	}
+	if len(a) != mockDimensions {
+		t.Errorf("Expected %d dimensions, got %d", mockDimensions, len(a))
+	}
+}
+
+func TestSearch(t *testing.T) {
+	cfg := testConf(t)
+
+	tests := []struct {
+		name     string
+		mode     SearchMode
+		question string
+		want     string
+	}{
+		{name: "vector", mode: ModeVector, question: "how many vacation days do I get per year?", want: "vacation.md"},
+		{name: "lexical", mode: ModeLexical, question: "remote work", want: "remote.md"},
+		{name: "hybrid", mode: ModeHybrid, question: "when does the office open in the morning?", want: "office.md"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frags, err := Search(cfg.WithMode(tt.mode), tt.question)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(frags) != 1 {
+				t.Fatalf("Expected 1 fragment, got %d", len(frags))
+			}
+			if frags[0].Name != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, frags[0].Name)
+			}
+		})
+	}
+}
+
+func TestSearchLimitsPerLabel(t *testing.T) {
+	cfg := testConf(t).WithLimits(ParseLimits([]string{"policies:2", "facilities:1"}))
+
+	frags, err := Search(cfg, "office hours")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	labels := map[string]int{}
+	for _, f := range frags {
+		labels[f.Label]++
+	}
+	if !reflect.DeepEqual(labels, map[string]int{"policies": 2, "facilities": 1}) {
+		t.Errorf("Expected 2 policies and 1 facilities fragment, got %v", labels)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	cfg := testConf(t).WithLimits(ParseLimits([]string{"3"}))
+
+	ans, err := Query(cfg, "how many vacation days do I get per year?")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ans.Answer != testDocuments[1].Content {
+		t.Errorf("Expected the answer %q, got %q", testDocuments[1].Content, ans.Answer)
+	}
+	if len(ans.Citations) != 1 || ans.Citations[0].Name != "vacation.md" {
+		t.Errorf("Expected vacation.md to be cited, got %v", ans.Citations)
+	}
+	if ans.ConfidenceScore <= 0 {
+		t.Errorf("Expected a positive confidence, got %v", ans.ConfidenceScore)
+	}
+	if ans.Metadata.TotalTokens == 0 {
+		t.Errorf("Expected token usage in the metadata")
+	}
+}
+
+func TestQueryUnanswerable(t *testing.T) {
+	cfg := testConf(t)
+
+	ans, err := Query(cfg, "what is the meaning of life?")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ans.Citations) != 0 {
+		t.Errorf("Expected no citations, got %v", ans.Citations)
+	}
+	if ans.ConfidenceScore != 0 {
+		t.Errorf("Expected no confidence, got %v", ans.ConfidenceScore)
+	}
+}
+
+func TestFill(t *testing.T) {
+	cfg := testConf(t).WithLimits(ParseLimits([]string{"3"}))
+
+	dir := t.TempDir()
+	cfg.in = filepath.Join(dir, "in.csv")
+	cfg.out = filepath.Join(dir, "out.csv")
+	cfg.delimiter = ","
+	cfg.withHeaders = true
+	err := os.WriteFile(cfg.in, []byte("question\nhow many vacation days per year?\nis remote work allowed?\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Fill(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	f, err := os.Open(cfg.out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"question", "answer", "sources"},
+		{"how many vacation days per year?", testDocuments[1].Content, "vacation.md"},
+		{"is remote work allowed?", testDocuments[0].Content, "remote.md"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("Expected %d rows, got %d: %v", len(want), len(rows), rows)
+	}
+	for i, row := range rows {
+		if len(row) != 4 {
+			t.Fatalf("Expected 4 columns in row %d, got %v", i, row)
+		}
+		// the confidence is left out, since it depends on the wording of the documents
+		got := []string{row[0], row[1], row[3]}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("Row %d: expected %v, got %v", i, want[i], got)
+		}
+	}
+}
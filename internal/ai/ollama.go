@@ -0,0 +1,182 @@
+package ai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/services/ollama"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ollamaBatch adds batch embedding to the bellman Ollama client, which only embeds one text per request, for
+// models served locally by Ollama, or any server implementing its api
+type ollamaBatch struct {
+	*ollama.Ollama
+	url string
+}
+
+type ollamaBatchRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type ollamaBatchResponse struct {
+	Embeddings      [][]float64 `json:"embeddings"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+// Embed embeds a text using the batch api, which unlike the bellman client passes on the context of the request
+func (o *ollamaBatch) Embed(req embed.Request) (*embed.Response, error) {
+	resp, err := o.EmbedBatch(BatchRequest{Ctx: req.Ctx, Model: req.Model, Texts: []string{req.Text}})
+	if err != nil {
+		return nil, err
+	}
+	return &embed.Response{Embedding: resp.Embeddings[0], Metadata: resp.Metadata}, nil
+}
+
+func (o *ollamaBatch) EmbedBatch(req BatchRequest) (*BatchResponse, error) {
+	body, err := json.Marshal(ollamaBatchRequest{
+		Model: req.Model.Name,
+		Input: req.Texts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal ollama request, %w", err)
+	}
+
+	u, err := url.JoinPath(o.url, "/api/embed")
+	if err != nil {
+		return nil, fmt.Errorf("could not join url, %w", err)
+	}
+	ctx := req.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create ollama request, %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("could not post ollama request, %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		d, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code, %d, %s", resp.StatusCode, string(d))
+	}
+
+	var respModel ollamaBatchResponse
+	err = json.NewDecoder(resp.Body).Decode(&respModel)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode ollama response, %w", err)
+	}
+	if len(respModel.Embeddings) != len(req.Texts) {
+		return nil, fmt.Errorf("expected %d embeddings in response, got %d", len(req.Texts), len(respModel.Embeddings))
+	}
+
+	return &BatchResponse{
+		Embeddings: respModel.Embeddings,
+		Metadata: models.Metadata{
+			Model:       req.Model.FQN(),
+			InputTokens: respModel.PromptEvalCount,
+			TotalTokens: respModel.PromptEvalCount,
+		},
+	}, nil
+}
+
+// ollamaStream streams chat completions of Ollama, which are sent as one json object per line
+type ollamaStream struct {
+	url string
+}
+
+type ollamaStreamMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ollamaStreamRequest struct {
+	Model    string                `json:"model"`
+	Messages []ollamaStreamMessage `json:"messages"`
+	Stream   bool                  `json:"stream"`
+	Options  struct {
+		NumPredict int `json:"num_predict,omitempty"`
+	} `json:"options"`
+}
+
+type ollamaStreamChunk struct {
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	Error           string `json:"error"`
+}
+
+func (o *ollamaStream) Provider() string {
+	return ollama.Provider
+}
+
+func (o *ollamaStream) Stream(req StreamRequest, onText func(text string)) (*gen.Response, error) {
+	body := ollamaStreamRequest{Model: req.Model.Name, Stream: true}
+	body.Options.NumPredict = req.MaxTokens
+	if req.System != "" {
+		body.Messages = append(body.Messages, ollamaStreamMessage{Role: "system", Content: req.System})
+	}
+	for _, p := range req.Prompts {
+		body.Messages = append(body.Messages, ollamaStreamMessage{Role: string(p.Role), Content: p.Text})
+	}
+
+	u, err := url.JoinPath(o.url, "/api/chat")
+	if err != nil {
+		return nil, fmt.Errorf("could not join url, %w", err)
+	}
+	stream, err := postStream(req.Ctx, u, body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ollama stream: %w", err)
+	}
+	defer stream.Close()
+
+	var text strings.Builder
+	metadata := models.Metadata{Model: req.Model.FQN()}
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var chunk ollamaStreamChunk
+		err := json.Unmarshal(line, &chunk)
+		if err != nil {
+			return nil, fmt.Errorf("ollama stream: could not decode chunk, %w", err)
+		}
+		if chunk.Error != "" {
+			return nil, fmt.Errorf("ollama stream: %s", chunk.Error)
+		}
+		if chunk.Message.Content != "" {
+			text.WriteString(chunk.Message.Content)
+			onText(chunk.Message.Content)
+		}
+		if chunk.Done {
+			metadata.InputTokens = chunk.PromptEvalCount
+			metadata.OutputTokens = chunk.EvalCount
+			metadata.TotalTokens = chunk.PromptEvalCount + chunk.EvalCount
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ollama stream: %w", err)
+	}
+	return &gen.Response{Texts: []string{text.String()}, Metadata: metadata}, nil
+}
@@ -0,0 +1,201 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/services/ollama"
+)
+
+// ollamaStub serves the embed and chat apis of Ollama, answering chat with the frames, one per line
+func ollamaStub(t *testing.T, frames ...string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/embed", func(w http.ResponseWriter, r *http.Request) {
+		var req ollamaBatchRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Model != "nomic-embed-text" {
+			http.Error(w, fmt.Sprintf(`{"error":"model %q not found"}`, req.Model), http.StatusNotFound)
+			return
+		}
+		var res ollamaBatchResponse
+		for i, text := range req.Input {
+			res.Embeddings = append(res.Embeddings, []float64{float64(i), float64(len(text))})
+			res.PromptEvalCount += len(strings.Fields(text))
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+	mux.HandleFunc("POST /api/chat", func(w http.ResponseWriter, r *http.Request) {
+		var req ollamaStreamRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || !req.Stream || req.Options.NumPredict <= 0 {
+			http.Error(w, "expected a streaming request with a token limit", http.StatusBadRequest)
+			return
+		}
+		if req.Model == "overloaded" {
+			http.Error(w, `{"error":"server busy"}`, http.StatusServiceUnavailable)
+			return
+		}
+		for _, frame := range frames {
+			fmt.Fprintln(w, frame)
+			w.(http.Flusher).Flush()
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOllamaEmbedBatch(t *testing.T) {
+	srv := ollamaStub(t)
+	client := &ollamaBatch{Ollama: ollama.New(srv.URL), url: srv.URL}
+	model := embed.Model{Provider: ollama.Provider, Name: "nomic-embed-text"}
+
+	res, err := client.EmbedBatch(BatchRequest{Ctx: context.Background(), Model: model, Texts: []string{"one", "two words"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res.Embeddings, [][]float64{{0, 3}, {1, 9}}) {
+		t.Errorf("Expected an embedding per text, in order, got %v", res.Embeddings)
+	}
+	if res.Metadata.InputTokens != 3 || res.Metadata.Model != "Ollama/nomic-embed-text" {
+		t.Errorf("Expected 3 input tokens of Ollama/nomic-embed-text, got %+v", res.Metadata)
+	}
+
+	one, err := client.Embed(embed.Request{Ctx: context.Background(), Model: model, Text: "single"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(one.Embedding, []float64{0, 6}) {
+		t.Errorf("Expected the embedding of the text, got %v", one.Embedding)
+	}
+}
+
+func TestOllamaErrorStatus(t *testing.T) {
+	srv := ollamaStub(t)
+
+	_, err := (&ollamaBatch{Ollama: ollama.New(srv.URL), url: srv.URL}).EmbedBatch(BatchRequest{
+		Model: embed.Model{Provider: ollama.Provider, Name: "missing"},
+		Texts: []string{"text"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Expected a 404 error, got %v", err)
+	}
+	if retryable(err) {
+		t.Errorf("Expected a missing model not to be retried, %v", err)
+	}
+
+	_, err = (&ollamaStream{url: srv.URL}).Stream(StreamRequest{
+		Model:     gen.Model{Provider: ollama.Provider, Name: "overloaded"},
+		Prompts:   []prompt.Prompt{prompt.AsUser("hello")},
+		MaxTokens: 100,
+	}, func(string) {})
+	if err == nil || !retryable(err) {
+		t.Errorf("Expected a retryable 503 error, got %v", err)
+	}
+}
+
+func TestOllamaStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []string
+		want   string
+		err    string
+	}{
+		{
+			name: "done",
+			frames: []string{
+				`{"message":{"role":"assistant","content":"Vacation is "},"done":false}`,
+				``,
+				`{"message":{"role":"assistant","content":"25 days."},"done":false}`,
+				`{"message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":12,"eval_count":5}`,
+			},
+			want: "Vacation is 25 days.",
+		},
+		{
+			name: "error frame",
+			frames: []string{
+				`{"message":{"role":"assistant","content":"Vacation"},"done":false}`,
+				`{"error":"model ran out of memory"}`,
+			},
+			want: "Vacation",
+			err:  "model ran out of memory",
+		},
+		{
+			name:   "invalid frame",
+			frames: []string{`{"message":`},
+			err:    "could not decode chunk",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := ollamaStub(t, tt.frames...)
+
+			var streamed strings.Builder
+			res, err := (&ollamaStream{url: srv.URL}).Stream(StreamRequest{
+				Ctx:       context.Background(),
+				Model:     gen.Model{Provider: ollama.Provider, Name: "llama3.2"},
+				System:    "be brief",
+				Prompts:   []prompt.Prompt{prompt.AsUser("how many vacation days?")},
+				MaxTokens: 100,
+			}, func(text string) { streamed.WriteString(text) })
+
+			if streamed.String() != tt.want {
+				t.Errorf("Expected %q to be streamed, got %q", tt.want, streamed.String())
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Expected an error containing %q, got %v", tt.err, err)
+				}
+				if retryable(err) {
+					t.Errorf("Expected the error not to be retried, %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if res.Texts[0] != tt.want {
+				t.Errorf("Expected the response %q, got %q", tt.want, res.Texts[0])
+			}
+			if res.Metadata.InputTokens != 12 || res.Metadata.OutputTokens != 5 || res.Metadata.TotalTokens != 17 {
+				t.Errorf("Expected the token counts of the done frame, got %+v", res.Metadata)
+			}
+		})
+	}
+}
+
+func TestOllamaStreamInterrupted(t *testing.T) {
+	srv := ollamaStub(t,
+		`{"message":{"role":"assistant","content":"Vacation"},"done":false}`,
+		`{"error":"model ran out of memory"}`,
+	)
+	proxy := newProxy()
+	proxy.RegisterStreamer(&ollamaStream{url: srv.URL})
+	proxy.RegisterGen(&mock{})
+
+	_, err := proxy.Stream(StreamRequest{
+		Ctx:       context.Background(),
+		Model:     gen.Model{Provider: ollama.Provider, Name: "llama3.2"},
+		Fallbacks: []gen.Model{{Provider: MockProvider, Name: "llm"}},
+		Prompts:   []prompt.Prompt{prompt.AsUser("hello")},
+	}, func(string) {})
+	if !errors.Is(err, errStreamInterrupted) {
+		t.Errorf("Expected a stream failing after text to be interrupted, without fallback, got %v", err)
+	}
+}
@@ -1,17 +1,23 @@
 package ai
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/modfin/bellman"
+	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/embed"
 	"github.com/modfin/bellman/models/gen"
 	"github.com/modfin/bellman/services/anthropic"
+	"github.com/modfin/bellman/services/ollama"
 	"github.com/modfin/bellman/services/openai"
 	"github.com/modfin/bellman/services/vertexai"
 	"github.com/modfin/bellman/services/voyageai"
+	"github.com/modfin/blot/internal/db"
 	"log/slog"
 	"strings"
+	"sync"
+	"time"
 )
 
 type APICredentials struct {
@@ -26,11 +32,17 @@ type APICredentials struct {
 	OpenAIKey    string `cli:"openai-key"`
 	AnthropicKey string `cli:"anthropic-key"`
 	VoyageAIKey  string `cli:"voyageai-key"`
+
+	OllamaURL string `cli:"ollama-url"`
 }
 
 func New(credentials APICredentials, logger *slog.Logger) (*Proxy, error) {
 	proxy := newProxy()
 
+	// the mock provider needs no credentials, nor network
+	proxy.RegisterGen(&mock{})
+	proxy.RegisterEmbeder(&mock{})
+
 	if credentials.AnthropicKey != "" {
 		client := anthropic.New(credentials.AnthropicKey)
 
@@ -38,6 +50,8 @@ func New(credentials APICredentials, logger *slog.Logger) (*Proxy, error) {
 
 		logger.Debug("adding llm provider", "provider", client.Provider())
 
+		proxy.RegisterStreamer(&anthropicStream{key: credentials.AnthropicKey})
+
 	}
 	if credentials.OpenAIKey != "" {
 		client := openai.New(credentials.OpenAIKey)
@@ -45,8 +59,9 @@ func New(credentials APICredentials, logger *slog.Logger) (*Proxy, error) {
 		proxy.RegisterGen(client)
 
 		logger.Debug("adding llm provider", "provider", client.Provider())
+		proxy.RegisterStreamer(&openAIStream{key: credentials.OpenAIKey})
 
-		proxy.RegisterEmbeder(client)
+		proxy.RegisterEmbeder(&openAIBatch{OpenAI: client, key: credentials.OpenAIKey})
 		logger.Debug("adding embed provider", "provider", client.Provider())
 
 	}
@@ -74,6 +89,19 @@ func New(credentials APICredentials, logger *slog.Logger) (*Proxy, error) {
 		client := voyageai.New(credentials.VoyageAIKey)
 		proxy.RegisterEmbeder(client)
 		logger.Debug("adding embed provider", "provider", client.Provider())
+
+		proxy.RegisterReranker(&voyageRerank{key: credentials.VoyageAIKey})
+		logger.Debug("adding rerank provider", "provider", client.Provider())
+	}
+
+	if credentials.OllamaURL != "" {
+		client := ollama.New(credentials.OllamaURL)
+		proxy.RegisterGen(client)
+		logger.Debug("adding llm provider", "provider", client.Provider(), "url", credentials.OllamaURL)
+		proxy.RegisterStreamer(&ollamaStream{url: credentials.OllamaURL})
+
+		proxy.RegisterEmbeder(&ollamaBatch{Ollama: client, url: credentials.OllamaURL})
+		logger.Debug("adding embed provider", "provider", client.Provider(), "url", credentials.OllamaURL)
 	}
 
 	if credentials.BellmanKey != "" && credentials.BellmanURL != "" {
@@ -96,14 +124,38 @@ var ErrNoModelProvided = errors.New("no model was provided")
 var ErrClientNotFound = errors.New("client not found")
 
 type Proxy struct {
-	embeders map[string]embed.Embeder
-	gens     map[string]gen.Gen
+	embeders  map[string]embed.Embeder
+	gens      map[string]gen.Gen
+	rerankers map[string]Reranker
+	streamers map[string]Streamer
+	limiters  map[string]*limiter
+	retries   int
+	backoff   time.Duration
+	cache     EmbedCache
+
+	ledger  Ledger
+	command string
+	prices  map[string]db.ModelPrice
+	budget  float64
+	// budgetOutputTokens are held back from the budget for requests without max tokens
+	budgetOutputTokens int
+
+	mu       sync.Mutex
+	spent    float64
+	reserved float64
 }
 
 func newProxy() *Proxy {
 	p := &Proxy{
-		embeders: map[string]embed.Embeder{},
-		gens:     map[string]gen.Gen{},
+		embeders:  map[string]embed.Embeder{},
+		gens:      map[string]gen.Gen{},
+		rerankers: map[string]Reranker{},
+		streamers: map[string]Streamer{},
+		limiters:  map[string]*limiter{},
+		retries:   defaultRetries,
+		backoff:   defaultRetryBackoff,
+
+		budgetOutputTokens: defaultBudgetOutputTokens,
 	}
 
 	return p
@@ -115,35 +167,144 @@ func (p *Proxy) RegisterEmbeder(embeder embed.Embeder) {
 func (p *Proxy) RegisterGen(llm gen.Gen) {
 	p.gens[llm.Provider()] = llm
 }
+func (p *Proxy) RegisterReranker(reranker Reranker) {
+	p.rerankers[reranker.Provider()] = reranker
+}
+func (p *Proxy) RegisterStreamer(streamer Streamer) {
+	p.streamers[streamer.Provider()] = streamer
+}
 
+// SetRateLimit limits the number of requests per minute, of embeddings and generations combined, to a provider
+func (p *Proxy) SetRateLimit(provider string, perMinute int) {
+	if perMinute <= 0 {
+		delete(p.limiters, provider)
+		return
+	}
+	p.limiters[provider] = newLimiter(perMinute)
+}
+
+// Embed embeds a text, retrying if the provider fails with a retryable error. There is no fallback to other
+// embedding models, since their vectors can not be compared with those already stored. If there is an embed
+// cache, texts that have been embedded before are returned from it
 func (p *Proxy) Embed(mod embed.Request) (*embed.Response, error) {
-	client, ok := p.embeders[mod.Model.Provider]
+	if p.cache != nil {
+		return p.cachedEmbed(mod)
+	}
+	return p.embed(mod)
+}
+
+func (p *Proxy) embed(mod embed.Request) (*embed.Response, error) {
+	return withRetries(p, mod.Ctx, mod.Model.Provider, func() (*embed.Response, error) {
+		client, model, err := p.embeder(mod.Ctx, mod.Model)
+		if err != nil {
+			return nil, err
+		}
+		req := mod
+		req.Model = model
+		return metered(p, mod.Ctx, "embed", mod.Model.FQN(), estimateTokens(mod.Text), 0, func() (*embed.Response, error) {
+			return client.Embed(req)
+		}, func(res *embed.Response) models.Metadata {
+			return res.Metadata
+		})
+	})
+}
+
+// EmbedBatch embeds several texts in one request, if the provider supports it, or one text at a time otherwise.
+// Batches are not cached, since they embed documents whose vectors are stored with their fragments
+func (p *Proxy) EmbedBatch(req BatchRequest) (*BatchResponse, error) {
+	if _, ok := p.embeders[req.Model.Provider].(BatchEmbeder); ok {
+		return withRetries(p, req.Ctx, req.Model.Provider, func() (*BatchResponse, error) {
+			client, model, err := p.embeder(req.Ctx, req.Model)
+			if err != nil {
+				return nil, err
+			}
+			return metered(p, req.Ctx, "embed", req.Model.FQN(), estimateTokens(req.Texts...), 0, func() (*BatchResponse, error) {
+				return client.(BatchEmbeder).EmbedBatch(BatchRequest{
+					Ctx:   req.Ctx,
+					Model: model,
+					Texts: req.Texts,
+				})
+			}, func(res *BatchResponse) models.Metadata {
+				return res.Metadata
+			})
+		})
+	}
+
+	res := &BatchResponse{Metadata: models.Metadata{Model: req.Model.FQN()}}
+	for _, text := range req.Texts {
+		resp, err := p.embed(embed.Request{
+			Ctx:   req.Ctx,
+			Model: req.Model,
+			Text:  text,
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.Embeddings = append(res.Embeddings, resp.AsFloat64())
+		res.Metadata.InputTokens += resp.Metadata.InputTokens
+		res.Metadata.TotalTokens += resp.Metadata.TotalTokens
+	}
+	return res, nil
+}
+
+// embeder finds the client of an embedding model, waiting for the rate limit of the provider if there is one,
+// and resolves the model name for bellman
+func (p *Proxy) embeder(ctx context.Context, mod embed.Model) (embed.Embeder, embed.Model, error) {
+	client, ok := p.embeders[mod.Provider]
 	if !ok {
-		return nil, fmt.Errorf("no client registerd for provider '%s', %w", mod.Model.Provider, ErrClientNotFound)
+		return nil, mod, fmt.Errorf("no client registerd for provider '%s', %w", mod.Provider, ErrClientNotFound)
 	}
 
 	if client == nil {
-		return nil, ErrNoModelProvided
+		return nil, mod, ErrNoModelProvided
 	}
 
-	if mod.Model.Provider == bellman.Provider {
-		provider, name, found := strings.Cut(mod.Model.Name, "/")
+	if lim, ok := p.limiters[mod.Provider]; ok {
+		err := lim.Wait(ctx)
+		if err != nil {
+			return nil, mod, err
+		}
+	}
+
+	if mod.Provider == bellman.Provider {
+		provider, name, found := strings.Cut(mod.Name, "/")
 
 		if !found {
-			return nil, fmt.Errorf("invalid bellman model name '%s', %w", mod.Model.Name, ErrNoModelProvided)
+			return nil, mod, fmt.Errorf("invalid bellman model name '%s', %w", mod.Name, ErrNoModelProvided)
 		}
-		mod.Model.Provider = provider
-		mod.Model.Name = name
+		mod.Provider = provider
+		mod.Name = name
+
+	}
+
+	if mod.Name == "" {
+		return nil, mod, fmt.Errorf("mod.Model.Name is not set, %w", ErrNoModelProvided)
+	}
+	return client, mod, nil
+}
 
+// Gen creates a generator of the model, whose prompts are retried on retryable errors. If fallbacks are given, a
+// prompt that fails on the model, after retries, is moved on to the fallbacks in order until one of them succeeds
+func (p *Proxy) Gen(mod gen.Model, fallbacks ...gen.Model) (*gen.Generator, error) {
+	generator, err := p.gen(mod)
+	if err != nil || len(fallbacks) == 0 {
+		return generator, err
 	}
 
-	if mod.Model.Name == "" {
-		return nil, fmt.Errorf("mod.Model.Name is not set, %w", ErrNoModelProvided)
+	chain := &fallbackPrompter{links: []fallbackLink{{model: generator.Request.Model, prompter: generator.Prompter}}}
+	for _, fallback := range fallbacks {
+		g, err := p.gen(fallback)
+		if err != nil {
+			return nil, fmt.Errorf("fallback '%s': %w", fallback.FQN(), err)
+		}
+		chain.links = append(chain.links, fallbackLink{model: g.Request.Model, prompter: g.Prompter})
 	}
-	return client.Embed(mod)
+	generator.Prompter = chain
+	return generator, nil
 }
 
-func (p *Proxy) Gen(mod gen.Model) (*gen.Generator, error) {
+func (p *Proxy) gen(mod gen.Model) (*gen.Generator, error) {
+	fqn := mod.FQN()
 	client, ok := p.gens[mod.Provider]
 	if !ok {
 		return nil, fmt.Errorf("no client registerd for provider '%s', %w", mod.Provider, ErrClientNotFound)
@@ -167,5 +328,11 @@ func (p *Proxy) Gen(mod gen.Model) (*gen.Generator, error) {
 		return nil, fmt.Errorf("mod.Name is not set, %w", ErrNoModelProvided)
 	}
 
-	return client.Generator(gen.WithModel(mod)), nil
+	generator := client.Generator(gen.WithModel(mod))
+	generator.Prompter = &meteredPrompter{Prompter: generator.Prompter, proxy: p, model: fqn}
+	if lim, ok := p.limiters[client.Provider()]; ok {
+		generator.Prompter = &limitedPrompter{Prompter: generator.Prompter, limiter: lim}
+	}
+	generator.Prompter = &retryPrompter{Prompter: generator.Prompter, proxy: p}
+	return generator, nil
 }
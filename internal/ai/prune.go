@@ -0,0 +1,47 @@
+package ai
+
+import (
+	"fmt"
+	"github.com/modfin/henry/slicez"
+)
+
+// Prune removes the fragments of every document with the label that is not one of the documents to keep, and
+// returns the removed documents. When dry running, the documents that would be removed are returned but kept.
+// As with adding, only the fragments embedded by the configured model are considered. Without documents to keep
+// Prune fails rather than removing the whole label, since that is more likely an empty list of files by mistake
+func Prune(cfg *Conf, label string, keep []string, dryRun bool) ([]string, error) {
+	if len(keep) == 0 {
+		return nil, fmt.Errorf("no files were given to prune the label %s by, which would remove all of its documents, "+
+			"use rm --label=%s to remove them", label, label)
+	}
+
+	documents, err := cfg.Dao.ListDocuments(cfg.ctx, label, cfg.EmbedModel.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list documents with label %s: %w", label, err)
+	}
+
+	stale := slicez.Complement(keep, documents)
+	if dryRun || len(stale) == 0 {
+		return stale, nil
+	}
+
+	tx, err := cfg.db.BeginTx(cfg.ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	dao := cfg.Dao.WithTx(tx)
+
+	for _, document := range stale {
+		_, err = dao.DeleteDocument(cfg.ctx, label, document, cfg.EmbedModel.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove %s: %w", document, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit removal: %w", err)
+	}
+	return stale, nil
+}
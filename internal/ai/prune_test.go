@@ -0,0 +1,30 @@
+package ai
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrune(t *testing.T) {
+	cfg := testConf(t)
+
+	_, err := Prune(cfg, "policies", nil, false)
+	if err == nil {
+		t.Fatalf("Expected pruning without files to keep to fail")
+	}
+
+	removed, err := Prune(cfg, "policies", []string{"remote.md"}, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{"vacation.md"}) {
+		t.Errorf("Expected vacation.md to be removed, got %v", removed)
+	}
+	documents, err := cfg.Dao.ListDocuments(cfg.ctx, "policies", cfg.EmbedModel.String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(documents, []string{"remote.md"}) {
+		t.Errorf("Expected remote.md to be kept, got %v", documents)
+	}
+}
@@ -3,41 +3,59 @@ package ai
 import (
 	"context"
 	"database/sql"
-	"encoding/csv"
 	"fmt"
 	"github.com/modfin/bellman/models/embed"
 	"github.com/modfin/bellman/models/gen"
 	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/schema"
+	"github.com/modfin/blot/internal/chunk"
 	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/blot/internal/db/vec"
 	"github.com/modfin/clix"
 	"github.com/modfin/henry/mapz"
 	"github.com/modfin/henry/slicez"
 	"github.com/urfave/cli/v3"
-	"io"
 	"log/slog"
-	"os"
+	"math"
 	"strconv"
 	"strings"
-	"time"
 )
 
 type Conf struct {
 	ctx         context.Context
 	credentials APICredentials
+	db          *sql.DB
 	Dao         *db.Queries
 	Proxy       *Proxy
 
 	EmbedModel embed.Model
 	LLMModel   gen.Model
+	// llmFallbacks are prompted in order if the LLMModel fails
+	llmFallbacks []gen.Model
 
 	SystemPrompt string
 
-	limits      map[string]int
-	in          string
-	out         string
-	delimiter   string
-	withHeaders bool
+	limits           map[string]int
+	mode             SearchMode
+	exact            bool
+	probes           int
+	ann              *annCache
+	encoding         vec.Encoding
+	metric           vec.Metric
+	minScore         float64
+	rerankModel      RerankModel
+	rerankCandidates int
+	mmrLambda        float64
+	chunking         chunk.Options
+	batchSize        int
+	batchTokens      int
+	in               string
+	out              string
+	delimiter        string
+	withHeaders      bool
+	resume           bool
+	keepGoing        bool
+	concurrency      int
 }
 
 func LoadConf(ctx context.Context, cmd *cli.Command) (*Conf, error) {
@@ -49,18 +67,45 @@ func LoadConf(ctx context.Context, cmd *cli.Command) (*Conf, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Proxy: %w", err)
 	}
+	for _, rl := range cmd.StringSlice("rate-limit") {
+		provider, strlimit, _ := strings.Cut(rl, ":")
+		limit, err := strconv.Atoi(strlimit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rate limit '%s', expected <provider>:<requests per minute>: %w", rl, err)
+		}
+		conf.Proxy.SetRateLimit(provider, limit)
+	}
 
-	conn, err := sql.Open("sqlite", cmd.String("db"))
+	dsn := cmd.String("db")
+	if !strings.Contains(dsn, "?") {
+		// waiting on locks rather than failing, and taking the write lock up front, since the serve
+		// command runs concurrent requests against the database
+		dsn += "?_pragma=busy_timeout(5000)&_txlock=immediate"
+	}
+	conn, err := db.Open(ctx, dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database file, %s: %w", "file://"+cmd.String("db"), err)
 	}
-	_, err = conn.ExecContext(ctx, db.Schema)
+	conf.db = conn
+	conf.Dao = db.New(conn)
+	if cmd.Bool("embed-cache") {
+		conf.Proxy.SetEmbedCache(conf.Dao)
+	}
+	prices, err := conf.Dao.ModelPrices(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create schema: %w", err)
+		return nil, fmt.Errorf("failed to read model prices: %w", err)
 	}
-	conf.Dao = db.New(conn)
+	conf.Proxy.SetPrices(prices)
+	conf.Proxy.SetLedger(conf.Dao, cmd.Name)
+	conf.Proxy.SetBudget(cmd.Float("budget"), int(cmd.Int("budget-output-tokens")))
+
+	conf.Proxy.SetRetries(int(cmd.Int("retries")), cmd.Duration("retry-backoff"))
 
 	embeddingModel := cmd.String("embed-model")
+	if strings.Contains(embeddingModel, ",") {
+		return nil, fmt.Errorf("invalid embed model '%s', fallback is not supported for embedding models, "+
+			"since vectors of different models can not be compared", embeddingModel)
+	}
 	provider, modelName, _ := strings.Cut(embeddingModel, "/")
 
 	slog.Default().Debug("embed model", "provider", provider, "model", modelName)
@@ -70,159 +115,242 @@ func LoadConf(ctx context.Context, cmd *cli.Command) (*Conf, error) {
 		Name:     modelName,
 	}
 
-	llmModel := cmd.String("llm-model")
-	provider, modelName, _ = strings.Cut(llmModel, "/")
-	slog.Default().Debug("llm model", "provider", provider, "model", modelName)
-	conf.LLMModel = gen.Model{
-		Provider: provider,
-		Name:     modelName,
-	}
+	llmModels := ParseLLMModels(cmd.String("llm-model"))
+	slog.Default().Debug("llm model", "provider", llmModels[0].Provider, "model", llmModels[0].Name, "fallbacks", len(llmModels)-1)
+	conf.LLMModel = llmModels[0]
+	conf.llmFallbacks = llmModels[1:]
 
 	conf.SystemPrompt = cmd.String("system-prompt")
 
-	conf.limits = slicez.Associate(cmd.StringSlice("limit"), func(lim string) (key string, value int) {
-		label, strlimit, found := strings.Cut(lim, ":")
-		if !found {
-			strlimit = label
-			label = "%"
+	conf.limits = ParseLimits(cmd.StringSlice("limit"))
+
+	conf.mode, err = ParseMode(cmd.String("mode"))
+	if err != nil {
+		return nil, err
+	}
+
+	conf.exact = cmd.Bool("exact")
+	conf.probes = int(cmd.Int("probes"))
+	conf.ann = &annCache{indexes: map[string]*annIndex{}}
+
+	conf.encoding, err = vec.ParseEncoding(cmd.String("vector-encoding"))
+	if err != nil {
+		return nil, err
+	}
+
+	conf.minScore = math.Inf(-1)
+	if cmd.IsSet("min-score") {
+		conf.minScore = cmd.Float("min-score")
+	}
+
+	conf.rerankModel = ParseRerankModel(cmd.String("rerank-model"))
+	conf.rerankCandidates = int(cmd.Int("rerank-candidates"))
+	if conf.rerankCandidates <= 0 {
+		conf.rerankCandidates = defaultRerankCandidates
+	}
+	err = CheckMinScore(&conf)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.mmrLambda = 1
+	if cmd.IsSet("mmr-lambda") {
+		conf.mmrLambda = cmd.Float("mmr-lambda")
+		if conf.mmrLambda < 0 || conf.mmrLambda > 1 {
+			return nil, fmt.Errorf("mmr lambda must be in [0, 1], got %v", conf.mmrLambda)
 		}
-		limit, err := strconv.Atoi(strlimit)
+	}
+
+	// an empty metric means the one recorded for the embedding model
+	if metric := cmd.String("metric"); metric != "" {
+		conf.metric, err = vec.ParseMetric(metric)
 		if err != nil {
-			slog.Default().Warn("failed to parse limit, defaulting to 5", "err", err)
-			limit = 5
+			return nil, err
 		}
-		return label, limit
-	})
+	}
+
+	conf.chunking = chunk.Options{
+		Strategy: chunk.Strategy(cmd.String("chunk-strategy")),
+		Size:     int(cmd.Int("chunk-size")),
+		Overlap:  int(cmd.Int("chunk-overlap")),
+	}
+
+	conf.batchSize = int(cmd.Int("embed-batch-size"))
+	if conf.batchSize <= 0 {
+		conf.batchSize = defaultEmbedBatchSize
+	}
+	conf.batchTokens = int(cmd.Int("embed-batch-tokens"))
+	if conf.batchTokens <= 0 {
+		conf.batchTokens = defaultEmbedBatchTokens
+	}
 
 	conf.in = cmd.String("in")
 	conf.out = cmd.String("out")
 	conf.delimiter = cmd.String("delimiter")
 	conf.withHeaders = cmd.Bool("with-headers")
+	conf.resume = cmd.Bool("resume")
+	conf.keepGoing = cmd.Bool("keep-going")
+	conf.concurrency = int(cmd.Int("concurrency"))
 
 	return &conf, nil
 
 }
 
-func Fill(cfg *Conf) error {
-
-	in, err := os.Open(cfg.in)
-	if err != nil {
-		return fmt.Errorf("failed to open input file: %w", err)
-	}
-	defer in.Close()
+// ParseLimits parses limits on the form <label>:<limit>, or just <limit> for all labels
+func ParseLimits(limits []string) map[string]int {
+	return slicez.Associate(limits, func(lim string) (key string, value int) {
+		label, strlimit, found := strings.Cut(lim, ":")
+		if !found {
+			strlimit = label
+			label = "%"
+		}
+		limit, err := strconv.Atoi(strlimit)
+		if err != nil {
+			slog.Default().Warn("failed to parse limit, defaulting to 5", "err", err)
+			limit = 5
+		}
+		return label, limit
+	})
+}
 
-	out, err := os.Create(cfg.out)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+func ParseMode(mode string) (SearchMode, error) {
+	switch SearchMode(mode) {
+	case "":
+		return ModeVector, nil
+	case ModeVector, ModeLexical, ModeHybrid:
+		return SearchMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown search mode '%s', expected vector, lexical or hybrid", mode)
 	}
-	defer out.Close()
+}
 
-	delimiter := cfg.delimiter
-	if len(delimiter) == 0 {
-		delimiter = "\t"
-	}
+// WithContext returns a copy of the configuration bound to ctx, sharing database and proxy with the original
+func (cfg *Conf) WithContext(ctx context.Context) *Conf {
+	c := *cfg
+	c.ctx = ctx
+	return &c
+}
 
-	csvin := csv.NewReader(in)
-	csvin.LazyQuotes = true
-	switch delimiter {
-	case "\\t":
-		csvin.Comma = '\t'
-	default:
-		csvin.Comma = rune(delimiter[0])
-	}
+func (cfg *Conf) Limits() map[string]int {
+	return cfg.limits
+}
 
-	csvout := csv.NewWriter(out)
-	csvout.Comma = csvin.Comma
-	defer csvout.Flush()
+func (cfg *Conf) WithLimits(limits map[string]int) *Conf {
+	c := *cfg
+	c.limits = limits
+	return &c
+}
 
-	var headers []string
-	getName := func(col int) string {
-		if len(headers) > col {
-			return headers[col]
-		}
-		return fmt.Sprintf("col_%d", col)
-	}
+func (cfg *Conf) WithMode(mode SearchMode) *Conf {
+	c := *cfg
+	c.mode = mode
+	return &c
+}
 
-	var inputTokens int
-	var outputTokens int
+func (cfg *Conf) WithEmbedModel(model embed.Model) *Conf {
+	c := *cfg
+	c.EmbedModel = model
+	return &c
+}
 
-	var row int
-	for {
-		start := time.Now()
+func (cfg *Conf) WithMetric(metric vec.Metric) *Conf {
+	c := *cfg
+	c.metric = metric
+	return &c
+}
 
-		row++
-		record, err := csvin.Read()
-		if err == io.EOF {
-			break
-		}
-		if row == 1 && cfg.withHeaders {
-			headers = append([]string{}, record...)
-			err = csvout.Write(append(record, "answer", "confidence_score"))
-			if err != nil {
-				return err
-			}
-			continue
-		}
+func (cfg *Conf) WithMinScore(minScore float64) *Conf {
+	c := *cfg
+	c.minScore = minScore
+	return &c
+}
 
-		var col int
-		cols := slicez.Map(record, func(s string) string {
-			name := getName(col)
-			col += 1
-			return fmt.Sprintf("<%s>\n  %s\n</%s>", name, s, name)
-		})
+func (cfg *Conf) WithRerankModel(model RerankModel) *Conf {
+	c := *cfg
+	c.rerankModel = model
+	return &c
+}
 
-		answer, err := Query(cfg, strings.Join(cols, "\n"))
-		if err != nil {
-			return fmt.Errorf("failed to Query: %w", err)
-		}
+func (cfg *Conf) WithMMRLambda(lambda float64) *Conf {
+	c := *cfg
+	c.mmrLambda = lambda
+	return &c
+}
 
-		inputTokens += answer.Metadata.InputTokens
-		outputTokens += answer.Metadata.OutputTokens
-		err = csvout.Write(append(record, answer.Answer, fmt.Sprintf("%.3f", answer.ConfidenceScore)))
-		if err != nil {
-			return fmt.Errorf("failed to write row: %w", err)
-		}
-		csvout.Flush()
+// WithLLMModel sets the llm model, and the models to fall back to if it fails, replacing any previous fallbacks
+func (cfg *Conf) WithLLMModel(model gen.Model, fallbacks ...gen.Model) *Conf {
+	c := *cfg
+	c.LLMModel = model
+	c.llmFallbacks = fallbacks
+	return &c
+}
 
-		slog.Default().Debug("Fill",
-			"row", row,
-			"confidence", answer.ConfidenceScore,
-			"took", time.Since(start),
-			"input-tokens", answer.Metadata.InputTokens,
-			"output-tokens", answer.Metadata.OutputTokens,
-			"input-tokens-total", inputTokens,
-			"output-tokens-total", outputTokens,
-		)
+// ParseLLMModels parses a comma separated chain of llm models, eg. OpenAI/gpt-4o-mini,Anthropic/claude-3-5-haiku-latest,
+// where the models following the first are its fallbacks. There is always at least one model
+func ParseLLMModels(s string) []gen.Model {
+	var models []gen.Model
+	for _, m := range strings.Split(s, ",") {
+		provider, name, _ := strings.Cut(strings.TrimSpace(m), "/")
+		models = append(models, gen.Model{Provider: provider, Name: name})
 	}
+	return models
+}
 
-	return nil
-
+func (cfg *Conf) WithSystemPrompt(systemPrompt string) *Conf {
+	c := *cfg
+	c.SystemPrompt = systemPrompt
+	return &c
 }
 
 func Search(cfg *Conf, question string) ([]db.Fragment, error) {
 
-	model := cfg.EmbedModel
-	model.Type = embed.TypeQuery
-
-	resp, err := cfg.Proxy.Embed(embed.Request{
-		Ctx:   cfg.ctx,
-		Model: model,
-		Text:  question,
-	})
+	err := CheckMinScore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = checkEmbeddingModel(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to embed: %w", err)
+		return nil, err
 	}
+	metric, err := searchMetric(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.WithMetric(metric)
+
+	var vector []float64
+	if cfg.mode != ModeLexical {
+		model := cfg.EmbedModel
+		model.Type = embed.TypeQuery
 
-	vector := resp.AsFloat64()
+		resp, err := cfg.Proxy.Embed(embed.Request{
+			Ctx:   cfg.ctx,
+			Model: model,
+			Text:  question,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed: %w", err)
+		}
+
+		vector = resp.AsFloat64()
+	}
 
 	fragments := slicez.FlatMap(mapz.Entries(cfg.limits), func(e mapz.Entry[string, int]) []db.Fragment {
-		slog.Default().Debug("knn search", "label", e.Key, "k", e.Value)
-		frags, err := cfg.Dao.KNN(cfg.ctx, vector, e.Key, e.Value)
+		slog.Default().Debug("search", "mode", cfg.mode, "label", e.Key, "k", e.Value)
+		frags, err := searchLabel(cfg, question, vector, e.Key, candidates(cfg, e.Value))
 		if err != nil {
 			slog.Default().Warn("failed to Query database for fragments", "err", err)
 		}
 
-		return frags
+		frags, reranked := rerank(cfg, question, frags)
+		if reranked || cfg.mode == ModeVector {
+			frags = slicez.Filter(frags, func(f db.Fragment) bool {
+				return f.Score >= cfg.minScore
+			})
+		} else if !math.IsInf(cfg.minScore, -1) && len(frags) > 0 {
+			slog.Default().Warn("fragments were not reranked, the min score is not applied to their retrieval scores", "label", e.Key)
+		}
+		return mmr(frags, cfg.mmrLambda, e.Value)
 	})
 
 	return slicez.UniqBy(fragments, func(a db.Fragment) int {
@@ -231,6 +359,79 @@ func Search(cfg *Conf, question string) ([]db.Fragment, error) {
 
 }
 
+// CheckMinScore refuses a min score for scores without a fixed scale, the bm25 ranks of lexical mode, which depend
+// on the documents, and the fused ranks of hybrid mode, which are at most 2 / 61. Reranked fragments are scored in
+// [0, 1] in every mode
+func CheckMinScore(cfg *Conf) error {
+	if math.IsInf(cfg.minScore, -1) || cfg.rerankModel.Provider != "" || cfg.mode == ModeVector {
+		return nil
+	}
+	return fmt.Errorf("a min score can not be used in %s mode, since its scores have no fixed scale. "+
+		"Use vector mode, or rerank the fragments to filter on their relevance in [0, 1]", cfg.mode)
+}
+
+// checkEmbeddingModel refuses to search a knowledge base where no fragment is embedded by the configured model,
+// since nothing would be found. Fragments of other models are never compared to, as their vectors are unrelated
+func checkEmbeddingModel(cfg *Conf) error {
+	model := cfg.EmbedModel.String()
+	ok, err := cfg.Dao.HasEmbeddingModel(cfg.ctx, model)
+	if err != nil {
+		return fmt.Errorf("failed to look up embedding model: %w", err)
+	}
+	if ok {
+		return nil
+	}
+
+	models, err := cfg.Dao.EmbeddingModels(cfg.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list embedding models: %w", err)
+	}
+	if len(models) == 0 {
+		return nil // empty knowledge base
+	}
+
+	found := slicez.Map(models, func(m db.ModelCount) string {
+		return fmt.Sprintf("%s (%d fragments)", m.EmbeddingModel, m.Fragments)
+	})
+	return fmt.Errorf("no fragments in the knowledge base are embedded with %s, it contains fragments embedded with %s. "+
+		"Search using the same model as the documents were added with, eg. --embed-model=%s, "+
+		"or embed them with %s using --embed-model=%s reembed --to=%s",
+		model, strings.Join(found, ", "), models[0].EmbeddingModel, model, models[0].EmbeddingModel, model)
+}
+
+// candidates is the number of fragments to retrieve for a label, which is more than the limit when the fragments
+// are reranked or diversified before the limit is applied
+func candidates(cfg *Conf, limit int) int {
+	n := limit
+	if cfg.rerankModel.Provider != "" {
+		n = max(n, cfg.rerankCandidates)
+	}
+	if cfg.mmrLambda < 1 {
+		n = max(n, limit*mmrCandidates)
+	}
+	return n
+}
+
+func searchLabel(cfg *Conf, question string, vector []float64, label string, limit int) ([]db.Fragment, error) {
+	switch cfg.mode {
+	case ModeLexical:
+		return cfg.Dao.LexicalSearch(cfg.ctx, question, cfg.EmbedModel.String(), label, limit)
+	case ModeHybrid:
+		candidates := limit * hybridCandidates
+		semantic, err := knn(cfg, vector, label, candidates)
+		if err != nil {
+			return nil, fmt.Errorf("failed knn search: %w", err)
+		}
+		lexical, err := cfg.Dao.LexicalSearch(cfg.ctx, question, cfg.EmbedModel.String(), label, candidates)
+		if err != nil {
+			return nil, fmt.Errorf("failed lexical search: %w", err)
+		}
+		return slicez.Take(fuse(semantic, lexical), limit), nil
+	default:
+		return knn(cfg, vector, label, limit)
+	}
+}
+
 func Query(cfg *Conf, question string) (Answer, error) {
 
 	fragments, err := Search(cfg, question)
@@ -238,25 +439,21 @@ func Query(cfg *Conf, question string) (Answer, error) {
 		return Answer{}, fmt.Errorf("failed to Search: %w", err)
 	}
 
-	llm, err := cfg.Proxy.Gen(cfg.LLMModel)
+	return answer(cfg, question, fragments, nil)
+}
+
+// answer prompts the llm to answer the question using the fragments, following the history of a conversation
+func answer(cfg *Conf, question string, fragments []db.Fragment, history []prompt.Prompt) (Answer, error) {
+	llm, err := cfg.Proxy.Gen(cfg.LLMModel, cfg.llmFallbacks...)
 	if err != nil {
 		return Answer{}, fmt.Errorf("failed to create llm: %w", err)
 	}
 
-	prompts := slicez.Map(fragments, func(frag db.Fragment) prompt.Prompt {
-		return prompt.Prompt{
-			Role: prompt.UserRole,
-			Text: fmt.Sprintf("<%s-document> %s </%s-document>", frag.Label, frag.Content, frag.Label),
-		}
-	})
-
 	res, err := llm.
+		WithContext(cfg.ctx).
 		System(cfg.SystemPrompt).
 		Output(schema.From(Answer{})).
-		Prompt(append(prompts, prompt.Prompt{
-			Role: prompt.UserRole,
-			Text: fmt.Sprintf("<user-question> %s </user-question>", question),
-		})...)
+		Prompt(answerPrompts(question, fragments, history)...)
 
 	if err != nil {
 		return Answer{}, fmt.Errorf("failed to generate response: %w", err)
@@ -268,6 +465,42 @@ func Query(cfg *Conf, question string) (Answer, error) {
 		return Answer{}, fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 	ans.Metadata = res.Metadata
+	cite(&ans, fragments)
 
 	return ans, nil
 }
+
+// answerPrompts gives the llm the history of the conversation, followed by the fragments and the question
+func answerPrompts(question string, fragments []db.Fragment, history []prompt.Prompt) []prompt.Prompt {
+	prompts := append(slicez.Clone(history), slicez.Map(fragments, func(frag db.Fragment) prompt.Prompt {
+		return prompt.Prompt{
+			Role: prompt.UserRole,
+			Text: fmt.Sprintf("<%s-document id=\"%d\" name=\"%s\" score=\"%.4f\"> %s </%s-document>", frag.Label, frag.ID, frag.Name, frag.Score, frag.Content, frag.Label),
+		}
+	})...)
+	return append(prompts, prompt.Prompt{
+		Role: prompt.UserRole,
+		Text: fmt.Sprintf("<user-question> %s </user-question>", question),
+	})
+}
+
+// cite resolves the sources of an answer to the fragments that was given to the llm, dropping any made up source
+func cite(ans *Answer, fragments []db.Fragment) {
+	byID := slicez.KeyBy(fragments, func(f db.Fragment) int {
+		return f.ID
+	})
+
+	var sources []int
+	var citations []db.Fragment
+	for _, id := range slicez.Uniq(ans.Sources) {
+		frag, ok := byID[id]
+		if !ok {
+			slog.Default().Warn("llm cited a document that was not retrieved, dropping it", "id", id)
+			continue
+		}
+		sources = append(sources, id)
+		citations = append(citations, frag)
+	}
+	ans.Sources = sources
+	ans.Citations = citations
+}
@@ -0,0 +1,46 @@
+package ai
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/henry/slicez"
+)
+
+func TestSearchMinScore(t *testing.T) {
+	cfg := testConf(t).WithLimits(ParseLimits([]string{"3"}))
+	rerankModel := RerankModel{Provider: MockProvider, Name: "llm"}
+
+	tests := []struct {
+		name   string
+		cfg    *Conf
+		want   []string
+		errMsg string
+	}{
+		{name: "vector", cfg: cfg.WithMinScore(0.5), want: []string{"vacation.md"}},
+		{name: "lexical", cfg: cfg.WithMode(ModeLexical).WithMinScore(0.3), errMsg: "a min score can not be used in lexical mode"},
+		{name: "hybrid", cfg: cfg.WithMode(ModeHybrid).WithMinScore(0.01), errMsg: "a min score can not be used in hybrid mode"},
+		{name: "reranked lexical", cfg: cfg.WithMode(ModeLexical).WithRerankModel(rerankModel).WithMinScore(0.2), want: []string{"vacation.md"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frags, err := Search(tt.cfg, "vacation days per year")
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Errorf("Expected an error containing %q, got %v", tt.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			names := slicez.Map(frags, func(f db.Fragment) string { return f.Name })
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, names)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package ai
+
+import (
+	"context"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"sync"
+	"time"
+)
+
+// limiter spaces out requests evenly, so that no more than the given number of requests per minute are started
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(perMinute int) *limiter {
+	return &limiter{interval: time.Minute / time.Duration(perMinute)}
+}
+
+// Wait blocks until the next request may be started, or ctx is done
+func (l *limiter) Wait(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedPrompter waits for the limiter before every prompt
+type limitedPrompter struct {
+	gen.Prompter
+	limiter *limiter
+	ctx     context.Context
+}
+
+func (p *limitedPrompter) SetRequest(request gen.Request) {
+	p.ctx = request.Context
+	p.Prompter.SetRequest(request)
+}
+
+func (p *limitedPrompter) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
+	err := p.limiter.Wait(p.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.Prompter.Prompt(prompts...)
+}
@@ -0,0 +1,205 @@
+package ai
+
+import (
+	"fmt"
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/blot/internal/db"
+	"log/slog"
+)
+
+// Reembed embeds the content of the fragments embedded by the configured model with another model, storing the
+// new fragments alongside the old ones. Fragments that already have an up to date counterpart for the target
+// model are skipped, so an interrupted run continues where it stopped, and target fragments beyond the chunks of
+// their document are removed, since the document has been chunked into fewer fragments since. With cutover, the fragments of the old
+// model are removed once every fragment has been embedded by the target model. Returns the number of fragments
+// that was embedded
+func Reembed(cfg *Conf, to embed.Model, label string, cutover bool) (int, error) {
+	from := cfg.EmbedModel.String()
+	if from == to.String() {
+		return 0, fmt.Errorf("fragments are already embedded with %s", from)
+	}
+	logger := slog.Default().With("from", from, "to", to.String())
+
+	params := db.PendingReembedParams{
+		From:  from,
+		To:    to.String(),
+		Label: label,
+		Limit: cfg.batchSize,
+	}
+	total, err := cfg.Dao.CountPendingReembed(cfg.ctx, params)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count fragments to embed: %w", err)
+	}
+	logger.Info("re-embedding fragments", "fragments", total)
+
+	target := cfg.WithEmbedModel(to)
+	model := to
+	model.Type = embed.TypeDocument
+
+	err = recordMetric(target)
+	if err != nil {
+		return 0, err
+	}
+
+	// loading the index before writing, it is needed to index the new fragments
+	_, err = target.annIndex(to.String())
+	if err != nil {
+		return 0, err
+	}
+
+	var done int
+	for {
+		page, err := cfg.Dao.PendingReembed(cfg.ctx, params)
+		if err != nil {
+			return done, fmt.Errorf("failed to read fragments to embed: %w", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+
+		err = reembedPage(target, model, page)
+		if err != nil {
+			return done, err
+		}
+
+		done += len(page)
+		params.AfterID = page[len(page)-1].ID
+		logger.Info("re-embedded fragments", "done", done, "total", total)
+	}
+
+	stale, err := cfg.Dao.DeleteStaleReembed(cfg.ctx, params)
+	if err != nil {
+		return done, fmt.Errorf("failed to remove stale fragments of %s: %w", to.String(), err)
+	}
+	if stale > 0 {
+		logger.Info("removed fragments beyond the chunks of their documents", "fragments", stale)
+	}
+
+	if cutover {
+		err = cutoverEmbeddingModel(cfg, label)
+		if err != nil {
+			return done, err
+		}
+	}
+
+	return done, EnsureIndex(target)
+}
+
+func reembedPage(cfg *Conf, model embed.Model, page []db.Fragment) error {
+	texts := make([]string, len(page))
+	for i, frag := range page {
+		texts[i] = frag.Content
+	}
+	vectors, err := embedTexts(cfg, model, texts)
+	if err != nil {
+		return err
+	}
+
+	tx, err := cfg.db.BeginTx(cfg.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	dao := cfg.Dao.WithTx(tx)
+
+	frags := make([]db.Fragment, 0, len(page))
+	for i, frag := range page {
+		added, err := dao.AddFragment(cfg.ctx, db.AddFragmentParams{
+			Label:           frag.Label,
+			Name:            frag.Name,
+			Document:        frag.Document,
+			ChunkIndex:      frag.ChunkIndex,
+			Content:         frag.Content,
+			EmbeddingModel:  model.String(),
+			EmbeddingVector: vectors[i],
+			Encoding:        cfg.encoding,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add fragment: %w", err)
+		}
+		frags = append(frags, added)
+	}
+
+	err = indexFragments(cfg, dao, frags)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit fragments: %w", err)
+	}
+	return nil
+}
+
+// cutoverEmbeddingModel removes the fragments of the configured model, and its index unless only a label is removed
+func cutoverEmbeddingModel(cfg *Conf, label string) error {
+	from := cfg.EmbedModel.String()
+
+	tx, err := cfg.db.BeginTx(cfg.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	dao := cfg.Dao.WithTx(tx)
+
+	removed, err := dao.DeleteEmbeddingModel(cfg.ctx, from, label)
+	if err != nil {
+		return fmt.Errorf("failed to remove fragments embedded with %s: %w", from, err)
+	}
+	if label == "" {
+		err = dao.DeleteCentroids(cfg.ctx, from)
+		if err != nil {
+			return fmt.Errorf("failed to remove index of %s: %w", from, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit cutover: %w", err)
+	}
+	cfg.dropAnnIndex(from)
+
+	slog.Default().Info("removed fragments of the old embedding model", "embed-model", from, "fragments", removed)
+	return nil
+}
+
+// Reencode stores the vectors of the fragments embedded by the configured model using the configured encoding.
+// Returns the number of fragments that was encoded. Encoding a quantized vector as float does not restore the
+// precision that was lost
+func Reencode(cfg *Conf) (int, error) {
+	model := cfg.EmbedModel.String()
+
+	var done int
+	for after := 0; ; {
+		page, err := cfg.Dao.FragmentVectors(cfg.ctx, model, after, annPageSize)
+		if err != nil {
+			return done, fmt.Errorf("failed to read vectors: %w", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+
+		tx, err := cfg.db.BeginTx(cfg.ctx, nil)
+		if err != nil {
+			return done, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		dao := cfg.Dao.WithTx(tx)
+		for _, f := range page {
+			err = dao.UpdateEmbeddingVector(cfg.ctx, f.ID, f.Vector, cfg.encoding)
+			if err != nil {
+				tx.Rollback()
+				return done, fmt.Errorf("failed to encode fragment %d: %w", f.ID, err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return done, fmt.Errorf("failed to commit vectors: %w", err)
+		}
+
+		done += len(page)
+		after = page[len(page)-1].ID
+		slog.Default().Info("encoded vectors", "embed-model", model, "encoding", cfg.encoding, "done", done)
+	}
+	return done, nil
+}
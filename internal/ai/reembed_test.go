@@ -0,0 +1,59 @@
+package ai
+
+import (
+	"testing"
+
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/blot/internal/chunk"
+)
+
+func TestReembedRemovesStaleChunks(t *testing.T) {
+	cfg := testConf(t)
+	cfg.chunking = chunk.Options{Strategy: chunk.Paragraph, Size: 40}
+	to := embed.Model{Provider: MockProvider, Name: "other"}
+
+	countTarget := func() int {
+		t.Helper()
+		n, err := cfg.Dao.CountFragments(cfg.ctx, to.String())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return n
+	}
+
+	_, err := AddDocument(cfg, "handbook", "onboarding.md", "Badges are collected at reception.\n\nLaptops are handed out by IT.\n\nLunch is served at noon.")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = Reembed(cfg, to, "", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := countTarget(); n != len(testDocuments)+3 {
+		t.Fatalf("Expected %d fragments of %s, got %d", len(testDocuments)+3, to, n)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		chunks  int
+	}{
+		// the third chunk of the target model is beyond the chunks of the document
+		{name: "two chunks", content: "Badges are collected at reception.\n\nLaptops are handed out by IT.", chunks: 2},
+		// a single chunk is named after the document, so the chunks of the target model are all stale
+		{name: "one chunk", content: "Badges are collected at reception.", chunks: 1},
+	}
+	for _, tt := range tests {
+		_, err = AddDocument(cfg, "handbook", "onboarding.md", tt.content)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_, err = Reembed(cfg, to, "", false)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if n := countTarget(); n != len(testDocuments)+tt.chunks {
+			t.Errorf("%s: expected %d fragments of %s, got %d", tt.name, len(testDocuments)+tt.chunks, to, n)
+		}
+	}
+}
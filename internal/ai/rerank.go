@@ -0,0 +1,256 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/schema"
+	"github.com/modfin/bellman/services/voyageai"
+	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/henry/slicez"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const defaultRerankCandidates = 20
+
+type RerankModel struct {
+	Provider string
+	Name     string
+}
+
+func (m RerankModel) String() string {
+	return m.Provider + "/" + m.Name
+}
+
+// ParseRerankModel parses a model on the form <provider>/<name>, where an empty string means no reranking
+func ParseRerankModel(s string) RerankModel {
+	if s == "" {
+		return RerankModel{}
+	}
+	provider, name, _ := strings.Cut(s, "/")
+	return RerankModel{Provider: provider, Name: name}
+}
+
+type RerankRequest struct {
+	Ctx       context.Context
+	Model     RerankModel
+	Query     string
+	Documents []string
+}
+
+type RerankResponse struct {
+	// Scores are the relevance of each document to the query, in the same order as the documents of the
+	// request, where higher is more relevant
+	Scores   []float64
+	Metadata models.Metadata
+}
+
+// Reranker is implemented by providers with dedicated rerank models
+type Reranker interface {
+	Provider() string
+	Rerank(req RerankRequest) (*RerankResponse, error)
+}
+
+// rerank reorders fragments by the score of the rerank model, keeping the retrieved order if reranking fails
+func rerank(cfg *Conf, question string, frags []db.Fragment) ([]db.Fragment, bool) {
+	if cfg.rerankModel.Provider == "" || len(frags) == 0 {
+		return frags, false
+	}
+
+	resp, err := cfg.Proxy.Rerank(RerankRequest{
+		Ctx:   cfg.ctx,
+		Model: cfg.rerankModel,
+		Query: question,
+		Documents: slicez.Map(frags, func(f db.Fragment) string {
+			return f.Content
+		}),
+	})
+	if err != nil {
+		slog.Default().Warn("failed to rerank fragments, keeping the retrieval order", "err", err)
+		return frags, false
+	}
+
+	reranked := make([]db.Fragment, len(frags))
+	copy(reranked, frags)
+	for i := range reranked {
+		reranked[i].Score = resp.Scores[i]
+	}
+	sort.SliceStable(reranked, func(i, j int) bool {
+		return reranked[i].Score > reranked[j].Score
+	})
+	return reranked, true
+}
+
+// Rerank scores documents using the rerank model of the provider, or by prompting its llm to grade them
+func (p *Proxy) Rerank(req RerankRequest) (*RerankResponse, error) {
+	var resp *RerankResponse
+	var err error
+
+	if client, ok := p.rerankers[req.Model.Provider]; ok {
+		resp, err = withRetries(p, req.Ctx, req.Model.Provider, func() (*RerankResponse, error) {
+			if lim, ok := p.limiters[req.Model.Provider]; ok {
+				err := lim.Wait(req.Ctx)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return metered(p, req.Ctx, "rerank", req.Model.String(), estimateTokens(append([]string{req.Query}, req.Documents...)...), 0, func() (*RerankResponse, error) {
+				return client.Rerank(req)
+			}, func(res *RerankResponse) models.Metadata {
+				return res.Metadata
+			})
+		})
+	} else {
+		resp, err = p.llmRerank(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Scores) != len(req.Documents) {
+		return nil, fmt.Errorf("expected %d rerank scores, got %d", len(req.Documents), len(resp.Scores))
+	}
+	return resp, nil
+}
+
+type rerankGrades struct {
+	Grades []rerankGrade `json:"grades" json-description:"the grade of every document, by its id"`
+}
+
+type rerankGrade struct {
+	ID    int     `json:"id" json-description:"the id of the document, as given by the id attribute of the document"`
+	Grade float64 `json:"grade" json-minimum:"0" json-maximum:"10" json-description:"how relevant the document is to the question, from 0 for not relevant at all to 10 for answering the question"`
+}
+
+const rerankSystemPrompt = `You grade how relevant documents are to a question. A document that answers the question is graded 10,
+a document on the topic of the question that does not answer it is graded around 5, and an unrelated document is graded 0.
+Grade every document.`
+
+// llmRerank grades documents by prompting an llm, scoring them in [0, 1]. Documents the llm does not grade scores 0
+func (p *Proxy) llmRerank(req RerankRequest) (*RerankResponse, error) {
+	llm, err := p.Gen(gen.Model{Provider: req.Model.Provider, Name: req.Model.Name})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rerank llm: %w", err)
+	}
+
+	var docs strings.Builder
+	for i, doc := range req.Documents {
+		fmt.Fprintf(&docs, "<document id=\"%d\"> %s </document>\n", i, doc)
+	}
+
+	res, err := llm.
+		WithContext(req.Ctx).
+		System(rerankSystemPrompt).
+		Output(schema.From(rerankGrades{})).
+		Prompt(
+			prompt.AsUser(docs.String()),
+			prompt.AsUser(fmt.Sprintf("<user-question> %s </user-question>", req.Query)),
+		)
+	if err != nil {
+		return nil, fmt.Errorf("failed to grade documents: %w", err)
+	}
+
+	var grades rerankGrades
+	err = res.Unmarshal(&grades)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal grades: %w", err)
+	}
+
+	scores := make([]float64, len(req.Documents))
+	for _, g := range grades.Grades {
+		if g.ID < 0 || g.ID >= len(scores) {
+			continue
+		}
+		scores[g.ID] = max(0, min(10, g.Grade)) / 10
+	}
+	return &RerankResponse{Scores: scores, Metadata: res.Metadata}, nil
+}
+
+// voyageRerank uses the rerank models of VoyageAI, which bellman does not support
+type voyageRerank struct {
+	key string
+}
+
+type voyageRerankRequest struct {
+	Query      string   `json:"query"`
+	Documents  []string `json:"documents"`
+	Model      string   `json:"model"`
+	Truncation bool     `json:"truncation"`
+}
+
+type voyageRerankResponse struct {
+	Data []struct {
+		Index          int     `json:"index"`
+		RelevanceScore float64 `json:"relevance_score"`
+	} `json:"data"`
+	Usage struct {
+		TotalTokens int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+func (v *voyageRerank) Provider() string {
+	return voyageai.Provider
+}
+
+func (v *voyageRerank) Rerank(req RerankRequest) (*RerankResponse, error) {
+	body, err := json.Marshal(voyageRerankRequest{
+		Query:      req.Query,
+		Documents:  req.Documents,
+		Model:      req.Model.Name,
+		Truncation: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal voyageai request, %w", err)
+	}
+
+	ctx := req.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", "https://api.voyageai.com/v1/rerank", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create voyageai request, %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+v.key)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("could not post voyageai request, %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		d, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code, %d, %s", resp.StatusCode, string(d))
+	}
+
+	var respModel voyageRerankResponse
+	err = json.NewDecoder(resp.Body).Decode(&respModel)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode voyageai response, %w", err)
+	}
+
+	scores := make([]float64, len(req.Documents))
+	for _, d := range respModel.Data {
+		if d.Index < 0 || d.Index >= len(scores) {
+			return nil, fmt.Errorf("rerank score of unknown document %d", d.Index)
+		}
+		scores[d.Index] = d.RelevanceScore
+	}
+	return &RerankResponse{
+		Scores: scores,
+		Metadata: models.Metadata{
+			Model:       req.Model.String(),
+			TotalTokens: respModel.Usage.TotalTokens,
+		},
+	}, nil
+}
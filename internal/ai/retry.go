@@ -0,0 +1,145 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetries      = 3
+	defaultRetryBackoff = time.Second
+	// maxRetryBackoff caps the exponential backoff, such that a provider that is down for a while is still retried
+	maxRetryBackoff = 30 * time.Second
+)
+
+// statusCodePattern finds the http status code in errors of the providers, eg. "unexpected status code, 429, ..."
+var statusCodePattern = regexp.MustCompile(`unexpected status code,? (\d{3})`)
+
+// retryable reports whether a request that failed with err may succeed if it is tried again, ie. when the provider
+// is rate limiting, has an internal error or could not be reached
+func retryable(err error) bool {
+	if err == nil || unrecoverable(err) {
+		return false
+	}
+	if m := statusCodePattern.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code == 408 || code == 429 || code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// unrecoverable reports whether a request that failed with err can neither be retried nor fallen back from, since
+// it was cancelled, would exceed the budget or has streamed part of its answer
+func unrecoverable(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrBudgetExceeded) || errors.Is(err, errStreamInterrupted)
+}
+
+// SetRetries sets the number of times a request failing with a retryable error is retried, waiting an exponentially
+// growing backoff, with jitter, between the attempts
+func (p *Proxy) SetRetries(retries int, backoff time.Duration) {
+	p.retries = max(retries, 0)
+	p.backoff = backoff
+	if p.backoff <= 0 {
+		p.backoff = defaultRetryBackoff
+	}
+}
+
+// retryDelay is the wait before retry attempt n, counted from 0, drawn from [delay/2, delay] so that concurrent
+// requests that failed together are not retried together
+func (p *Proxy) retryDelay(n int) time.Duration {
+	delay := min(p.backoff<<n, maxRetryBackoff)
+	if delay <= 0 {
+		delay = maxRetryBackoff // overflowed
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// withRetries calls f until it succeeds, fails with an error that is not retryable or the retries are used up
+func withRetries[T any](p *Proxy, ctx context.Context, provider string, f func() (T, error)) (T, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for n := 0; ; n++ {
+		res, err := f()
+		if n >= p.retries || !retryable(err) {
+			return res, err
+		}
+
+		delay := p.retryDelay(n)
+		slog.Default().Warn("request failed, retrying", "provider", provider, "attempt", n+1, "retries", p.retries, "delay", delay, "err", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return res, errors.Join(ctx.Err(), err)
+		}
+	}
+}
+
+// retryPrompter retries prompts that fail with a retryable error
+type retryPrompter struct {
+	gen.Prompter
+	proxy   *Proxy
+	request gen.Request
+}
+
+func (p *retryPrompter) SetRequest(request gen.Request) {
+	p.request = request
+	p.Prompter.SetRequest(request)
+}
+
+func (p *retryPrompter) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
+	return withRetries(p.proxy, p.request.Context, p.request.Model.Provider, func() (*gen.Response, error) {
+		return p.Prompter.Prompt(prompts...)
+	})
+}
+
+type fallbackLink struct {
+	model    gen.Model
+	prompter gen.Prompter
+}
+
+// fallbackPrompter prompts the models of a chain in order, moving on to the next model when one fails, after its
+// retries, until one of them succeeds
+type fallbackPrompter struct {
+	links   []fallbackLink
+	request gen.Request
+}
+
+func (p *fallbackPrompter) SetRequest(request gen.Request) {
+	p.request = request
+}
+
+func (p *fallbackPrompter) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
+	var errs []error
+	for i, link := range p.links {
+		request := p.request
+		request.Model = link.model
+		link.prompter.SetRequest(request)
+
+		res, err := link.prompter.Prompt(prompts...)
+		if err == nil {
+			return res, nil
+		}
+		if unrecoverable(err) {
+			return nil, err
+		}
+		errs = append(errs, err)
+		if i+1 < len(p.links) {
+			slog.Default().Warn("llm failed, falling back to the next model", "model", link.model.FQN(), "fallback", p.links[i+1].model.FQN(), "err", err)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
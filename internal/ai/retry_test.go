@@ -0,0 +1,199 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+)
+
+// failing is a provider whose requests fail with the status code the number of failures, or always if negative
+type failing struct {
+	status   int
+	failures int
+	calls    int
+}
+
+func (f *failing) Provider() string {
+	return "Failing"
+}
+
+func (f *failing) fail() error {
+	f.calls++
+	if f.failures >= 0 && f.calls > f.failures {
+		return nil
+	}
+	return fmt.Errorf("unexpected status code, %d, err: something went wrong", f.status)
+}
+
+func (f *failing) Embed(req embed.Request) (*embed.Response, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return (&mock{}).Embed(req)
+}
+
+func (f *failing) Generator(options ...gen.Option) *gen.Generator {
+	g := &gen.Generator{Prompter: &failingPrompter{failing: f}}
+	for _, op := range options {
+		g = op(g)
+	}
+	return g
+}
+
+type failingPrompter struct {
+	mockPrompter
+	failing *failing
+}
+
+func (p *failingPrompter) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
+	if err := p.failing.fail(); err != nil {
+		return nil, err
+	}
+	return p.mockPrompter.Prompt(prompts...)
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: errors.New("unexpected status code, 429, err: rate limited"), want: true},
+		{err: errors.New("unexpected status code, 503: err overloaded"), want: true},
+		{err: errors.New("unexpected status code, 400, err: bad request"), want: false},
+		{err: errors.New("unexpected status code, 401, err: unauthorized"), want: false},
+		{err: fmt.Errorf("could not post request, %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), want: true},
+		{err: fmt.Errorf("could not post request, %w", context.Canceled), want: false},
+		{err: fmt.Errorf("%w, %w", errStreamInterrupted, errors.New("unexpected status code, 500")), want: false},
+		{err: errors.New("could not decode response"), want: false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%q): expected %v, got %v", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestGenRetries(t *testing.T) {
+	f := &failing{status: 429, failures: 2}
+	proxy := newProxy()
+	proxy.RegisterGen(f)
+	proxy.SetRetries(2, time.Millisecond)
+
+	llm, err := proxy.Gen(gen.Model{Provider: "Failing", Name: "llm"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = llm.Prompt(prompt.AsUser("hello"))
+	if err != nil {
+		t.Fatalf("Expected the prompt to succeed after retries, got %v", err)
+	}
+	if f.calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", f.calls)
+	}
+}
+
+func TestGenRetriesStopWhenCancelled(t *testing.T) {
+	f := &failing{status: 503, failures: -1}
+	proxy := newProxy()
+	proxy.RegisterGen(f)
+	proxy.RegisterGen(&mock{})
+	proxy.SetRetries(5, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	llm, err := proxy.Gen(gen.Model{Provider: "Failing", Name: "llm"}, gen.Model{Provider: MockProvider, Name: "llm"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	start := time.Now()
+	_, err = llm.WithContext(ctx).Prompt(prompt.AsUser("hello"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the prompt to be cancelled, without falling back, got %v", err)
+	}
+	if took := time.Since(start); took > 10*time.Second {
+		t.Errorf("Expected the backoff to stop when cancelled, took %v", took)
+	}
+	if f.calls != 1 {
+		t.Errorf("Expected 1 call, got %d", f.calls)
+	}
+}
+
+func TestGenFallsBack(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		calls  int
+	}{
+		{name: "after retries", status: 500, calls: 3},
+		{name: "without retrying", status: 400, calls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &failing{status: tt.status, failures: -1}
+			proxy := newProxy()
+			proxy.RegisterGen(f)
+			proxy.RegisterGen(&mock{})
+			proxy.SetRetries(2, time.Millisecond)
+
+			llm, err := proxy.Gen(gen.Model{Provider: "Failing", Name: "llm"}, gen.Model{Provider: MockProvider, Name: "llm"})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			res, err := llm.Prompt(prompt.AsUser("hello"))
+			if err != nil {
+				t.Fatalf("Expected the fallback to answer, got %v", err)
+			}
+			if res.Metadata.Model != "Mock/llm" {
+				t.Errorf("Expected the answer of Mock/llm, got %s", res.Metadata.Model)
+			}
+			if f.calls != tt.calls {
+				t.Errorf("Expected %d calls, got %d", tt.calls, f.calls)
+			}
+		})
+	}
+}
+
+func TestStreamFallsBack(t *testing.T) {
+	f := &failing{status: 503, failures: -1}
+	proxy := newProxy()
+	proxy.RegisterGen(f)
+	proxy.RegisterGen(&mock{})
+	proxy.SetRetries(0, time.Millisecond)
+
+	var text string
+	res, err := proxy.Stream(StreamRequest{
+		Ctx:       context.Background(),
+		Model:     gen.Model{Provider: "Failing", Name: "llm"},
+		Fallbacks: []gen.Model{{Provider: MockProvider, Name: "llm"}},
+		Prompts:   []prompt.Prompt{prompt.AsUser("hello")},
+	}, func(s string) { text += s })
+	if err != nil {
+		t.Fatalf("Expected the fallback to answer, got %v", err)
+	}
+	if res.Metadata.Model != "Mock/llm" || text == "" {
+		t.Errorf("Expected text streamed by Mock/llm, got %q by %s", text, res.Metadata.Model)
+	}
+}
+
+func TestEmbedRetriesWithoutFallback(t *testing.T) {
+	f := &failing{status: 429, failures: -1}
+	proxy := newProxy()
+	proxy.RegisterEmbeder(f)
+	proxy.SetRetries(2, time.Millisecond)
+
+	_, err := proxy.Embed(embed.Request{Ctx: context.Background(), Model: embed.Model{Provider: "Failing", Name: "embed"}, Text: "hello"})
+	if err == nil {
+		t.Fatalf("Expected an error once the retries are used up")
+	}
+	if f.calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", f.calls)
+	}
+}
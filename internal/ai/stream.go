@@ -0,0 +1,449 @@
+package ai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/services/anthropic"
+	"github.com/modfin/bellman/services/openai"
+	"github.com/modfin/blot/internal/db"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+type StreamRequest struct {
+	Ctx   context.Context
+	Model gen.Model
+	// Fallbacks are streamed from in order if the model fails before any text has been streamed
+	Fallbacks []gen.Model
+	System    string
+	Prompts   []prompt.Prompt
+	// MaxTokens limits the length of the response, defaults to the output tokens held back by the budget
+	MaxTokens int
+}
+
+// Streamer is implemented by providers that can stream generated text, which bellman does not support
+type Streamer interface {
+	Provider() string
+	// Stream generates a text response, calling onText with every piece of text as it arrives. The response
+	// holds the full text once the generation is done
+	Stream(req StreamRequest, onText func(text string)) (*gen.Response, error)
+}
+
+// errStreamInterrupted marks streams that failed after text was passed on, which can not be retried
+var errStreamInterrupted = errors.New("stream was interrupted")
+
+// Stream generates text using the streaming api of the provider, or otherwise passes the full text to onText at once
+func (p *Proxy) Stream(req StreamRequest, onText func(text string)) (*gen.Response, error) {
+	chain := append([]gen.Model{req.Model}, req.Fallbacks...)
+
+	var errs []error
+	for i, model := range chain {
+		link := req
+		link.Model = model
+		link.Fallbacks = nil
+		res, err := p.stream(link, onText)
+		if err == nil {
+			return res, nil
+		}
+		if unrecoverable(err) {
+			return nil, err
+		}
+		errs = append(errs, err)
+		if i+1 < len(chain) {
+			slog.Default().Warn("llm failed, falling back to the next model", "model", model.FQN(), "fallback", chain[i+1].FQN(), "err", err)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (p *Proxy) stream(req StreamRequest, onText func(text string)) (*gen.Response, error) {
+	if req.MaxTokens <= 0 {
+		req.MaxTokens = p.budgetOutputTokens
+	}
+
+	client, ok := p.streamers[req.Model.Provider]
+	if !ok {
+		llm, err := p.Gen(req.Model)
+		if err != nil {
+			return nil, err
+		}
+		res, err := llm.WithContext(req.Ctx).MaxTokens(req.MaxTokens).System(req.System).Prompt(req.Prompts...)
+		if err != nil {
+			return nil, err
+		}
+		text, err := res.AsText()
+		if err != nil {
+			return nil, err
+		}
+		onText(text)
+		return res, nil
+	}
+
+	return withRetries(p, req.Ctx, req.Model.Provider, func() (*gen.Response, error) {
+		if lim, ok := p.limiters[req.Model.Provider]; ok {
+			err := lim.Wait(req.Ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		texts := []string{req.System}
+		for _, pr := range req.Prompts {
+			texts = append(texts, pr.Text)
+		}
+		var streamed bool
+		res, err := metered(p, req.Ctx, "gen", req.Model.FQN(), estimateTokens(texts...), req.MaxTokens, func() (*gen.Response, error) {
+			return client.Stream(req, func(text string) {
+				streamed = true
+				onText(text)
+			})
+		}, func(res *gen.Response) models.Metadata {
+			return res.Metadata
+		})
+		if err != nil && streamed {
+			return nil, fmt.Errorf("%w, %w", errStreamInterrupted, err)
+		}
+		return res, err
+	})
+}
+
+// answerMetadataTag encloses the structured part of a streamed answer, which follows the answer itself
+const answerMetadataTag = "answer-metadata"
+
+const streamInstructions = `
+
+Write the answer as plain text. After the answer, on a line of its own, write a json object with your confidence in the answer,
+and the ids of the documents the answer is based on, enclosed in <answer-metadata> tags, eg.
+<answer-metadata>{"confidence_score": 0.8, "sources": [12, 34]}</answer-metadata>`
+
+// QueryStream answers the question like Query, but writes the answer to w as it is generated
+func QueryStream(cfg *Conf, question string, w io.Writer) (Answer, error) {
+
+	fragments, err := Search(cfg, question)
+	if err != nil {
+		return Answer{}, fmt.Errorf("failed to Search: %w", err)
+	}
+
+	return streamAnswer(cfg, question, fragments, nil, w)
+}
+
+// streamAnswer prompts the llm like answer, writing the answer to w as it is generated
+func streamAnswer(cfg *Conf, question string, fragments []db.Fragment, history []prompt.Prompt, w io.Writer) (Answer, error) {
+	printer := &answerPrinter{w: w}
+	res, err := cfg.Proxy.Stream(StreamRequest{
+		Ctx:       cfg.ctx,
+		Model:     cfg.LLMModel,
+		Fallbacks: cfg.llmFallbacks,
+		System:    strings.TrimSpace(cfg.SystemPrompt + streamInstructions),
+		Prompts:   answerPrompts(question, fragments, history),
+	}, printer.write)
+	if err != nil {
+		return Answer{}, fmt.Errorf("failed to generate response: %w", err)
+	}
+	printer.flush()
+
+	ans := parseStreamedAnswer(printer.text.String())
+	ans.Metadata = res.Metadata
+	cite(&ans, fragments)
+	return ans, nil
+}
+
+// answerPrinter writes streamed text up until the answer metadata
+type answerPrinter struct {
+	w       io.Writer
+	text    strings.Builder
+	printed int
+	done    bool
+}
+
+func (p *answerPrinter) write(text string) {
+	p.text.WriteString(text)
+	if p.done {
+		return
+	}
+
+	tag := "<" + answerMetadataTag + ">"
+	s := p.text.String()
+	end := len(s)
+	if i := strings.Index(s, tag); i >= 0 {
+		end = i
+		p.done = true
+	} else {
+		for k := min(len(tag)-1, len(s)); k > 0; k-- {
+			if strings.HasSuffix(s, tag[:k]) {
+				end = len(s) - k
+				break
+			}
+		}
+	}
+	// trailing whitespace is held back as well, since it may be followed by the metadata
+	end = len(strings.TrimRight(s[:end], " \n"))
+	if end > p.printed {
+		fmt.Fprint(p.w, s[p.printed:end])
+		p.printed = end
+	}
+}
+
+// flush writes any held back text of an answer that ended without metadata
+func (p *answerPrinter) flush() {
+	if p.done {
+		return
+	}
+	s := strings.TrimRight(p.text.String(), " \n")
+	if len(s) > p.printed {
+		fmt.Fprint(p.w, s[p.printed:])
+		p.printed = len(s)
+	}
+}
+
+// parseStreamedAnswer splits a streamed answer into the answer and its metadata
+func parseStreamedAnswer(text string) Answer {
+	answer, rest, found := strings.Cut(text, "<"+answerMetadataTag+">")
+	ans := Answer{Answer: strings.TrimSpace(answer)}
+	if !found {
+		slog.Default().Warn("streamed answer has no metadata, it has no sources")
+		return ans
+	}
+
+	metadata, _, _ := strings.Cut(rest, "</"+answerMetadataTag+">")
+	err := json.Unmarshal([]byte(strings.TrimSpace(metadata)), &ans)
+	if err != nil {
+		slog.Default().Warn("failed to parse the metadata of the streamed answer, it has no sources", "err", err)
+	}
+	ans.Answer = strings.TrimSpace(answer)
+	return ans
+}
+
+// readEvents reads server sent events, calling onData with the data of every event until the stream ends
+func readEvents(r io.Reader, onData func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+		err := onData(data)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// postStream posts a request to a streaming api, returning the body of the response to read the events from
+func postStream(ctx context.Context, url string, body any, headers map[string]string) (io.ReadCloser, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal request, %w", err)
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request, %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	for k, v := range headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("could not post request, %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		d, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code, %d, %s", resp.StatusCode, string(d))
+	}
+	return resp.Body, nil
+}
+
+// openAIStream streams chat completions of OpenAI
+type openAIStream struct {
+	key string
+}
+
+type openAIStreamMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIStreamRequest struct {
+	Model               string                `json:"model"`
+	Messages            []openAIStreamMessage `json:"messages"`
+	MaxCompletionTokens int                   `json:"max_completion_tokens,omitempty"`
+	Stream              bool                  `json:"stream"`
+	StreamOptions       struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+func (o *openAIStream) Provider() string {
+	return openai.Provider
+}
+
+func (o *openAIStream) Stream(req StreamRequest, onText func(text string)) (*gen.Response, error) {
+	body := openAIStreamRequest{Model: req.Model.Name, MaxCompletionTokens: req.MaxTokens, Stream: true}
+	body.StreamOptions.IncludeUsage = true
+	if req.System != "" {
+		body.Messages = append(body.Messages, openAIStreamMessage{Role: "system", Content: req.System})
+	}
+	for _, p := range req.Prompts {
+		body.Messages = append(body.Messages, openAIStreamMessage{Role: string(p.Role), Content: p.Text})
+	}
+
+	stream, err := postStream(req.Ctx, "https://api.openai.com/v1/chat/completions", body, map[string]string{
+		"Authorization": "Bearer " + o.key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("openai stream: %w", err)
+	}
+	defer stream.Close()
+
+	var text strings.Builder
+	metadata := models.Metadata{Model: req.Model.FQN()}
+	err = readEvents(stream, func(data []byte) error {
+		if string(data) == "[DONE]" {
+			return nil
+		}
+		var chunk openAIStreamChunk
+		err := json.Unmarshal(data, &chunk)
+		if err != nil {
+			return fmt.Errorf("could not decode openai event, %w", err)
+		}
+		for _, c := range chunk.Choices {
+			if c.Delta.Content != "" {
+				text.WriteString(c.Delta.Content)
+				onText(c.Delta.Content)
+			}
+		}
+		if chunk.Usage != nil {
+			metadata.InputTokens = chunk.Usage.PromptTokens
+			metadata.OutputTokens = chunk.Usage.CompletionTokens
+			metadata.TotalTokens = chunk.Usage.TotalTokens
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("openai stream: %w", err)
+	}
+	return &gen.Response{Texts: []string{text.String()}, Metadata: metadata}, nil
+}
+
+// anthropicStream streams messages of Anthropic
+type anthropicStream struct {
+	key string
+}
+
+type anthropicStreamMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicStreamRequest struct {
+	Model     string                   `json:"model"`
+	System    string                   `json:"system,omitempty"`
+	Messages  []anthropicStreamMessage `json:"messages"`
+	MaxTokens int                      `json:"max_tokens"`
+	Stream    bool                     `json:"stream"`
+}
+
+type anthropicStreamEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Text string `json:"text"`
+	} `json:"delta"`
+	Message struct {
+		Usage struct {
+			InputTokens int `json:"input_tokens"`
+		} `json:"usage"`
+	} `json:"message"`
+	Usage struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (a *anthropicStream) Provider() string {
+	return anthropic.Provider
+}
+
+func (a *anthropicStream) Stream(req StreamRequest, onText func(text string)) (*gen.Response, error) {
+	body := anthropicStreamRequest{Model: req.Model.Name, System: req.System, MaxTokens: req.MaxTokens, Stream: true}
+	for _, p := range req.Prompts {
+		// consecutive messages of the same role are merged, since the api expects the roles to alternate
+		if n := len(body.Messages); n > 0 && body.Messages[n-1].Role == string(p.Role) {
+			body.Messages[n-1].Content += "\n" + p.Text
+			continue
+		}
+		body.Messages = append(body.Messages, anthropicStreamMessage{Role: string(p.Role), Content: p.Text})
+	}
+
+	stream, err := postStream(req.Ctx, "https://api.anthropic.com/v1/messages", body, map[string]string{
+		"x-api-key":         a.key,
+		"anthropic-version": anthropic.Version,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("anthropic stream: %w", err)
+	}
+	defer stream.Close()
+
+	var text strings.Builder
+	metadata := models.Metadata{Model: req.Model.FQN()}
+	err = readEvents(stream, func(data []byte) error {
+		var event anthropicStreamEvent
+		err := json.Unmarshal(data, &event)
+		if err != nil {
+			return fmt.Errorf("could not decode anthropic event, %w", err)
+		}
+		switch event.Type {
+		case "message_start":
+			metadata.InputTokens = event.Message.Usage.InputTokens
+		case "content_block_delta":
+			text.WriteString(event.Delta.Text)
+			onText(event.Delta.Text)
+		case "message_delta":
+			metadata.OutputTokens = event.Usage.OutputTokens
+		case "error":
+			return fmt.Errorf("anthropic error event, %s", event.Error.Message)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("anthropic stream: %w", err)
+	}
+	metadata.TotalTokens = metadata.InputTokens + metadata.OutputTokens
+	return &gen.Response{Texts: []string{text.String()}, Metadata: metadata}, nil
+}
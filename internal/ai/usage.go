@@ -0,0 +1,173 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/modfin/bellman"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/blot/internal/db"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ErrBudgetExceeded is returned by requests that could exceed the budget, which are never sent
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Ledger records the usage of every request to a model. db.Queries implements it, keeping the ledger in the
+// knowledge base
+type Ledger interface {
+	AddUsage(ctx context.Context, arg db.AddUsageParams) error
+}
+
+// SetLedger records the usage of every request in the ledger, on behalf of the command
+func (p *Proxy) SetLedger(ledger Ledger, command string) {
+	p.ledger = ledger
+	p.command = command
+}
+
+// SetPrices sets the prices, per million tokens, the cost of requests are calculated by
+func (p *Proxy) SetPrices(prices []db.ModelPrice) {
+	p.prices = map[string]db.ModelPrice{}
+	for _, price := range prices {
+		p.prices[price.Model] = price
+	}
+}
+
+// defaultBudgetOutputTokens is the number of output tokens held back from the budget for requests to llms that
+// do not limit their max tokens
+const defaultBudgetOutputTokens = 4096
+
+// SetBudget limits the cost of the requests sent through the proxy, in USD. A request is not sent unless its worst
+// case cost fits in what is left of the budget, where the input is estimated from the length of the text and the
+// output is the max tokens of the request, or outputTokens if it has none. The part of the worst case that the
+// response did not use is released once it arrives. 0 is no limit
+func (p *Proxy) SetBudget(budget float64, outputTokens int) {
+	p.budget = max(budget, 0)
+	p.budgetOutputTokens = outputTokens
+	if p.budgetOutputTokens <= 0 {
+		p.budgetOutputTokens = defaultBudgetOutputTokens
+	}
+}
+
+// Spent returns the cost of the requests sent through the proxy, in USD
+func (p *Proxy) Spent() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.spent
+}
+
+// Priced reports whether the model has a price, models without price are free as far as the budget is concerned
+func (p *Proxy) Priced(model string) bool {
+	_, ok := p.price(model)
+	return ok
+}
+
+func (p *Proxy) price(model string) (db.ModelPrice, bool) {
+	price, ok := p.prices[model]
+	if !ok && strings.HasPrefix(model, bellman.Provider+"/") {
+		// bellman proxies the model of another provider, eg. Bellman/OpenAI/gpt-4o-mini
+		price, ok = p.prices[strings.TrimPrefix(model, bellman.Provider+"/")]
+	}
+	return price, ok
+}
+
+func (p *Proxy) cost(model string, inputTokens int, outputTokens int) float64 {
+	price, _ := p.price(model)
+	return (float64(inputTokens)*price.InputPrice + float64(outputTokens)*price.OutputPrice) / 1_000_000
+}
+
+// metered sends a request to the model by calling f, once the worst case cost of its input and output tokens fits
+// in the budget, and records the tokens used by the response, as given by metadata, in the ledger. Failed requests
+// are recorded with their error and latency
+func metered[T any](p *Proxy, ctx context.Context, kind string, model string, inputTokens int, outputTokens int, f func() (T, error), metadata func(T) models.Metadata) (T, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	estimate := p.cost(model, inputTokens, outputTokens)
+	p.mu.Lock()
+	if p.budget > 0 && p.spent+p.reserved+estimate > p.budget {
+		spent := p.spent
+		p.mu.Unlock()
+		var zero T
+		return zero, fmt.Errorf("%w, $%.4f of $%.4f spent, and %s could cost up to $%.4f", ErrBudgetExceeded, spent, p.budget, model, estimate)
+	}
+	// the worst case is reserved while the request is in flight, such that concurrent requests share the budget
+	p.reserved += estimate
+	p.mu.Unlock()
+
+	start := time.Now()
+	res, err := f()
+	latency := time.Since(start)
+
+	var usage models.Metadata
+	if err == nil {
+		usage = metadata(res)
+	}
+	input, output := usage.InputTokens, usage.OutputTokens
+	if input == 0 && output == 0 {
+		input = usage.TotalTokens // eg. embeddings, which only report the total
+	}
+	cost := p.cost(model, input, output)
+
+	p.mu.Lock()
+	p.reserved -= estimate
+	p.spent += cost
+	p.mu.Unlock()
+
+	if p.ledger == nil {
+		return res, err
+	}
+	var failure string
+	if err != nil {
+		failure = err.Error()
+	}
+	ledgerErr := p.ledger.AddUsage(ctx, db.AddUsageParams{
+		Command:      p.command,
+		Kind:         kind,
+		Model:        model,
+		InputTokens:  input,
+		OutputTokens: output,
+		TotalTokens:  max(usage.TotalTokens, input+output),
+		Cost:         cost,
+		LatencyMs:    int(latency.Milliseconds()),
+		Error:        failure,
+	})
+	if ledgerErr != nil {
+		slog.Default().Warn("failed to record usage", "model", model, "err", ledgerErr)
+	}
+	return res, err
+}
+
+// meteredPrompter records the usage of every prompt of a model, and stops prompts that would exceed the budget
+type meteredPrompter struct {
+	gen.Prompter
+	proxy   *Proxy
+	model   string
+	request gen.Request
+}
+
+func (p *meteredPrompter) SetRequest(request gen.Request) {
+	p.request = request
+	p.Prompter.SetRequest(request)
+}
+
+func (p *meteredPrompter) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
+	texts := []string{p.request.SystemPrompt}
+	for _, pr := range prompts {
+		texts = append(texts, pr.Text)
+	}
+	outputTokens := p.proxy.budgetOutputTokens
+	if p.request.MaxTokens != nil {
+		outputTokens = *p.request.MaxTokens
+	}
+	return metered(p.proxy, p.request.Context, "gen", p.model, estimateTokens(texts...), outputTokens, func() (*gen.Response, error) {
+		return p.Prompter.Prompt(prompts...)
+	}, func(res *gen.Response) models.Metadata {
+		return res.Metadata
+	})
+}
@@ -0,0 +1,131 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/blot/internal/db"
+)
+
+func meteredConf(t *testing.T) *Conf {
+	t.Helper()
+	cfg := testConf(t)
+	cfg.Proxy.SetLedger(cfg.Dao, "test")
+	cfg.Proxy.SetPrices([]db.ModelPrice{
+		{Model: "Mock/embed", InputPrice: 10},
+		{Model: "Mock/llm", InputPrice: 100, OutputPrice: 200},
+	})
+	return cfg
+}
+
+func TestUsageLedger(t *testing.T) {
+	cfg := meteredConf(t)
+
+	ans, err := Query(cfg, "how many vacation days do I get per year?")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	usage, err := cfg.Dao.UsageReport(context.Background(), db.UsageReportParams{By: []string{"kind", "command"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(usage) != 2 || usage[0].Kind != "embed" || usage[1].Kind != "gen" || usage[1].Command != "test" {
+		t.Fatalf("Expected one embed and one gen of the command, got %v", usage)
+	}
+
+	gen := usage[1]
+	if gen.InputTokens != ans.Metadata.InputTokens || gen.OutputTokens != ans.Metadata.OutputTokens {
+		t.Errorf("Expected the tokens of the answer, %v, got %v", ans.Metadata, gen)
+	}
+	want := (float64(gen.InputTokens)*100 + float64(gen.OutputTokens)*200) / 1_000_000
+	if diff := gen.Cost - want; diff > 1e-12 || diff < -1e-12 {
+		t.Errorf("Expected a cost of %v, got %v", want, gen.Cost)
+	}
+	if spent := cfg.Proxy.Spent(); spent != usage[0].Cost+gen.Cost {
+		t.Errorf("Expected %v spent, got %v", usage[0].Cost+gen.Cost, spent)
+	}
+}
+
+func TestUsageLedgerFailures(t *testing.T) {
+	cfg := meteredConf(t)
+	cfg.Proxy.RegisterGen(&failing{status: 429, failures: 1})
+	cfg.Proxy.SetRetries(1, time.Millisecond)
+
+	llm, err := cfg.Proxy.Gen(gen.Model{Provider: "Failing", Name: "llm"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = llm.Prompt(prompt.AsUser("hello"))
+	if err != nil {
+		t.Fatalf("Expected the prompt to succeed after a retry, got %v", err)
+	}
+
+	usage, err := cfg.Dao.UsageReport(context.Background(), db.UsageReportParams{By: []string{"model"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(usage) != 1 || usage[0].Model != "Failing/llm" {
+		t.Fatalf("Expected the usage of Failing/llm, got %v", usage)
+	}
+	if usage[0].Requests != 2 || usage[0].Errors != 1 {
+		t.Errorf("Expected 2 requests of which 1 failed, got %+v", usage[0])
+	}
+}
+
+func TestFillBudget(t *testing.T) {
+	cfg := meteredConf(t).WithLimits(ParseLimits([]string{"3"}))
+	cfg.Proxy.SetBudget(0.01, 20)
+
+	dir := t.TempDir()
+	cfg.in = filepath.Join(dir, "in.csv")
+	cfg.out = filepath.Join(dir, "out.csv")
+	cfg.delimiter = ","
+	cfg.withHeaders = true
+	cfg.keepGoing = true
+	err := os.WriteFile(cfg.in, []byte("question\nhow many vacation days per year?\nis remote work allowed?\nwhen does the office open?\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Fill(cfg)
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("Expected the fill to be aborted by the budget, got %v", err)
+	}
+	if spent := cfg.Proxy.Spent(); spent > 0.01 {
+		t.Errorf("Expected at most $0.01 to be spent, got $%v", spent)
+	}
+}
+
+func TestBudgetHoldsBackOutput(t *testing.T) {
+	cfg := meteredConf(t)
+	// the input of the prompt costs about $0.0002, while 100 output tokens could cost $0.02
+	cfg.Proxy.SetBudget(0.01, 100)
+
+	llm, err := cfg.Proxy.Gen(cfg.LLMModel)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = llm.Prompt(prompt.AsUser("how many vacation days do I get per year?"))
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("Expected the prompt to be refused since its output could exceed the budget, got %v", err)
+	}
+	if spent := cfg.Proxy.Spent(); spent != 0 {
+		t.Errorf("Expected nothing to be spent, got $%v", spent)
+	}
+
+	// limiting the max tokens of the request makes its worst case fit in the budget
+	_, err = llm.MaxTokens(10).Prompt(prompt.AsUser("how many vacation days do I get per year?"))
+	if err != nil {
+		t.Fatalf("Expected the prompt to fit in the budget, got %v", err)
+	}
+	if spent := cfg.Proxy.Spent(); spent <= 0 || spent > 0.01 {
+		t.Errorf("Expected the cost of the prompt to be spent, got $%v", spent)
+	}
+}
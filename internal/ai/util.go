@@ -1,9 +1,16 @@
 package ai
 
-import "github.com/modfin/bellman/models"
+import (
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/blot/internal/db"
+)
 
 type Answer struct {
 	Answer          string          `json:"answer,omitempty" json-description:"The answer to the question"`
 	ConfidenceScore float32         `json:"confidence_score,omitempty" json-minimum:"0.0" json-maximum:"1.0" json-description:"a confidence score between [0.0, 1.0] that denotes how confident the llm model is in the answer given to the question. This scored is assessed by looking at the RAG retrieved documents and comparing it to the answer"`
+	Sources         []int           `json:"sources,omitempty" json-description:"the ids of the RAG retrieved documents that the answer is based on, as given by the id attribute of each document. Only list documents that support a claim in the answer"`
 	Metadata        models.Metadata `json:"-"`
+
+	// Citations are the fragments referred to by Sources, any source that is not one of the fragments passed to the llm is dropped
+	Citations []db.Fragment `json:"-"`
 }
@@ -0,0 +1,162 @@
+package chat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/modfin/blot/internal/ai"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+var errExit = errors.New("exit")
+
+const help = `Ask a question, or use a command:
+  /limit <limit>...     set the number of fragments to retrieve, eg. /limit 5 or /limit QA:3 policies:2
+  /labels <label>...    only retrieve fragments with the labels, using the largest current limit for each
+  /model <models>       set the llm and its fallbacks, eg. /model Anthropic/claude-3-5-haiku-latest,OpenAI/gpt-4o-mini
+  /mode <mode>          set the search mode, vector, lexical or hybrid
+  /system <prompt>      set the system prompt
+  /reset                forget the conversation, also in the session if any
+  /help                 show this help
+  /exit                 end the chat`
+
+// REPL reads questions line by line and answers them as a conversation, until the input ends or /exit
+type REPL struct {
+	cfg          *ai.Conf
+	conversation *ai.Conversation
+	in           *bufio.Scanner
+	out          io.Writer
+}
+
+// New creates a REPL continuing the conversation, which may be a persisted session
+func New(cfg *ai.Conf, conversation *ai.Conversation, in io.Reader, out io.Writer) *REPL {
+	return &REPL{cfg: cfg, conversation: conversation, in: bufio.NewScanner(in), out: out}
+}
+
+func (r *REPL) Run() error {
+	fmt.Fprintln(r.out, "Chatting with the knowledge base, /help for commands and /exit to quit")
+	if r.conversation.Session != "" {
+		fmt.Fprintf(r.out, "Session %s, continuing after %d turns\n", r.conversation.Session, len(r.conversation.Turns))
+	}
+	for {
+		fmt.Fprint(r.out, "> ")
+		if !r.in.Scan() {
+			fmt.Fprintln(r.out)
+			return r.in.Err()
+		}
+		line := strings.TrimSpace(r.in.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "/") {
+			err := r.command(line)
+			if errors.Is(err, errExit) {
+				return nil
+			}
+			if err != nil {
+				fmt.Fprintf(r.out, "error: %v\n", err)
+			}
+			continue
+		}
+
+		ans, err := r.conversation.Ask(r.cfg, line)
+		if err != nil {
+			fmt.Fprintf(r.out, "error: %v\n", err)
+			continue
+		}
+		slog.Default().Debug("llm statistics",
+			"tokens-input", ans.Metadata.InputTokens,
+			"tokens-output", ans.Metadata.OutputTokens,
+			"tokens-total", ans.Metadata.TotalTokens,
+			"model", ans.Metadata.Model,
+			"confidence", ans.ConfidenceScore,
+		)
+
+		fmt.Fprintln(r.out, ans.Answer)
+		if len(ans.Citations) > 0 {
+			fmt.Fprintln(r.out)
+			fmt.Fprintln(r.out, "Sources:")
+			for _, frag := range ans.Citations {
+				fmt.Fprintf(r.out, "  - %s\n", frag.Name)
+			}
+		}
+		fmt.Fprintln(r.out)
+	}
+}
+
+func (r *REPL) command(line string) error {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	args := strings.Fields(arg)
+
+	switch name {
+	case "/exit", "/quit":
+		return errExit
+
+	case "/help":
+		fmt.Fprintln(r.out, help)
+
+	case "/reset":
+		err := r.conversation.Reset(r.cfg)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(r.out, "forgot the conversation")
+
+	case "/limit":
+		if len(args) == 0 {
+			return fmt.Errorf("expected limits, eg. /limit 5 or /limit QA:3 policies:2")
+		}
+		r.cfg = r.cfg.WithLimits(ai.ParseLimits(args))
+		fmt.Fprintf(r.out, "limits set to %v\n", r.cfg.Limits())
+
+	case "/labels":
+		if len(args) == 0 {
+			return fmt.Errorf("expected labels, eg. /labels QA policies")
+		}
+		limit := 0
+		for _, l := range r.cfg.Limits() {
+			limit = max(limit, l)
+		}
+		if limit == 0 {
+			limit = 5
+		}
+		limits := make([]string, len(args))
+		for i, label := range args {
+			limits[i] = label + ":" + strconv.Itoa(limit)
+		}
+		r.cfg = r.cfg.WithLimits(ai.ParseLimits(limits))
+		fmt.Fprintf(r.out, "limits set to %v\n", r.cfg.Limits())
+
+	case "/model":
+		models := ai.ParseLLMModels(arg)
+		for _, m := range models {
+			if m.Provider == "" || m.Name == "" {
+				return fmt.Errorf("expected a model on the form <provider>/<model>, optionally followed by fallbacks, " +
+					"eg. /model OpenAI/gpt-4o or /model OpenAI/gpt-4o,Anthropic/claude-3-5-haiku-latest")
+			}
+		}
+		r.cfg = r.cfg.WithLLMModel(models[0], models[1:]...)
+		fmt.Fprintf(r.out, "llm set to %s\n", arg)
+
+	case "/mode":
+		mode, err := ai.ParseMode(arg)
+		if err != nil {
+			return err
+		}
+		r.cfg = r.cfg.WithMode(mode)
+		fmt.Fprintf(r.out, "search mode set to %s\n", mode)
+
+	case "/system":
+		r.cfg = r.cfg.WithSystemPrompt(arg)
+		fmt.Fprintln(r.out, "system prompt set")
+
+	default:
+		return fmt.Errorf("unknown command %s, /help lists the commands", name)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/modfin/blot/internal/db"
+	"io"
+	"time"
+)
+
+// Transcript is a persisted session with its turns, as it is shown and exported
+type Transcript struct {
+	Session db.Session       `json:"session"`
+	Turns   []TranscriptTurn `json:"turns"`
+}
+
+type TranscriptTurn struct {
+	db.SessionTurn
+	// SourceNames are the names of the cited fragments, in the order of Sources. Fragments that has since been
+	// removed from the knowledge base are named by their id
+	SourceNames []string `json:"source_names"`
+}
+
+// LoadTranscript reads the named session and its turns
+func LoadTranscript(ctx context.Context, dao *db.Queries, name string) (Transcript, error) {
+	if name == "" {
+		return Transcript{}, fmt.Errorf("expected a session name")
+	}
+	session, err := dao.GetSession(ctx, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Transcript{}, fmt.Errorf("no session named '%s'", name)
+	}
+	if err != nil {
+		return Transcript{}, fmt.Errorf("failed to get session %s: %w", name, err)
+	}
+	turns, err := dao.SessionTurns(ctx, session.ID)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("failed to read turns of session %s: %w", name, err)
+	}
+
+	names := map[int]string{}
+	t := Transcript{Session: session}
+	for _, turn := range turns {
+		tt := TranscriptTurn{SessionTurn: turn, SourceNames: []string{}}
+		for _, id := range turn.Sources {
+			if _, ok := names[id]; !ok {
+				frag, err := dao.GetFragment(ctx, id)
+				switch {
+				case errors.Is(err, sql.ErrNoRows):
+					names[id] = fmt.Sprintf("#%d (removed)", id)
+				case err != nil:
+					return Transcript{}, fmt.Errorf("failed to get fragment %d: %w", id, err)
+				default:
+					names[id] = frag.Name
+				}
+			}
+			tt.SourceNames = append(tt.SourceNames, names[id])
+		}
+		t.Turns = append(t.Turns, tt)
+	}
+	return t, nil
+}
+
+func (t Transcript) JSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t)
+}
+
+func (t Transcript) Markdown(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# %s\n\n%d turns, %d tokens, started %s\n",
+		t.Session.Name, t.Session.Turns, t.Session.TotalTokens,
+		time.Unix(int64(t.Session.CreatedAt), 0).Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+
+	for _, turn := range t.Turns {
+		_, err = fmt.Fprintf(w, "\n## %s\n\n%s\n", turn.Question, turn.Answer)
+		if err != nil {
+			return err
+		}
+		if len(turn.SourceNames) > 0 {
+			fmt.Fprintln(w, "\nSources:")
+			for _, name := range turn.SourceNames {
+				fmt.Fprintf(w, "  - %s\n", name)
+			}
+		}
+		_, err = fmt.Fprintf(w, "\n_%s, %d fragments retrieved, %d tokens, %s_\n",
+			turn.LLMModel, len(turn.FragmentIDs), turn.TotalTokens,
+			time.Unix(int64(turn.CreatedAt), 0).Format(time.DateTime))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/blot/internal/db/vec"
+)
+
+// testTranscript loads a session of two turns, where the first cites a fragment in the knowledge base and one that
+// has been removed
+func testTranscript(t *testing.T) Transcript {
+	t.Helper()
+	ctx := context.Background()
+
+	conn, err := db.Open(ctx, filepath.Join(t.TempDir(), "blot.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	dao := db.New(conn)
+
+	frag, err := dao.AddFragment(ctx, db.AddFragmentParams{
+		Label:           "policies",
+		Name:            "vacation.md",
+		Document:        "vacation.md",
+		Content:         "Vacation is twenty five days per year.",
+		EmbeddingModel:  "Mock/embed",
+		EmbeddingVector: []float64{1, 0},
+		Encoding:        vec.DefaultEncoding,
+	})
+	if err != nil {
+		t.Fatalf("Failed to add fragment: %v", err)
+	}
+
+	session, err := dao.CreateSession(ctx, "onboarding")
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	for _, turn := range []db.AddSessionTurnParams{
+		{SessionID: session.ID, Question: "how many vacation days?", Answer: "Twenty five days per year.",
+			Sources: []int{frag.ID, frag.ID + 100}, FragmentIDs: []int{frag.ID}, LLMModel: "Mock/llm", TotalTokens: 12},
+		{SessionID: session.ID, Question: "and sick days?", Answer: "The documents do not say.",
+			LLMModel: "Mock/llm", TotalTokens: 8},
+	} {
+		err = dao.AddSessionTurn(ctx, turn)
+		if err != nil {
+			t.Fatalf("Failed to add turn: %v", err)
+		}
+	}
+
+	_, err = LoadTranscript(ctx, dao, "missing")
+	if err == nil || err.Error() != "no session named 'missing'" {
+		t.Errorf("Expected a missing session to be reported, got %v", err)
+	}
+
+	transcript, err := LoadTranscript(ctx, dao, "onboarding")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return transcript
+}
+
+func TestLoadTranscript(t *testing.T) {
+	transcript := testTranscript(t)
+
+	if transcript.Session.Name != "onboarding" || transcript.Session.Turns != 2 || transcript.Session.TotalTokens != 20 {
+		t.Errorf("Expected the onboarding session of 2 turns and 20 tokens, got %+v", transcript.Session)
+	}
+	if len(transcript.Turns) != 2 {
+		t.Fatalf("Expected 2 turns, got %d", len(transcript.Turns))
+	}
+	removed := fmt.Sprintf("#%d (removed)", transcript.Turns[0].Sources[1])
+	if !reflect.DeepEqual(transcript.Turns[0].SourceNames, []string{"vacation.md", removed}) {
+		t.Errorf("Expected the sources to be named, and the removed one by its id, got %v", transcript.Turns[0].SourceNames)
+	}
+	if transcript.Turns[1].SourceNames == nil || len(transcript.Turns[1].SourceNames) != 0 {
+		t.Errorf("Expected a turn without sources to have no source names, got %v", transcript.Turns[1].SourceNames)
+	}
+}
+
+func TestTranscriptMarkdown(t *testing.T) {
+	transcript := testTranscript(t)
+
+	var buf bytes.Buffer
+	err := transcript.Markdown(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	md := buf.String()
+
+	for _, want := range []string{
+		"# onboarding\n\n2 turns, 20 tokens, started ",
+		"\n## how many vacation days?\n\nTwenty five days per year.\n",
+		"\nSources:\n  - vacation.md\n  - " + transcript.Turns[0].SourceNames[1] + "\n",
+		"\n_Mock/llm, 1 fragments retrieved, 12 tokens, ",
+		"\n## and sick days?\n\nThe documents do not say.\n\n_Mock/llm, 0 fragments retrieved, 8 tokens, ",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("Expected the markdown to contain %q, got\n%s", want, md)
+		}
+	}
+	if strings.Count(md, "Sources:") != 1 {
+		t.Errorf("Expected only the turn with sources to list them, got\n%s", md)
+	}
+}
+
+func TestTranscriptJSON(t *testing.T) {
+	transcript := testTranscript(t)
+
+	var buf bytes.Buffer
+	err := transcript.JSON(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var got Transcript
+	err = json.Unmarshal(buf.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("Failed to decode the exported transcript: %v", err)
+	}
+	if !reflect.DeepEqual(got, transcript) {
+		t.Errorf("Expected the export to decode into the transcript, got %+v, want %+v", got, transcript)
+	}
+
+	var raw struct {
+		Turns []map[string]any `json:"turns"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"question", "answer", "sources", "source_names", "fragment_ids", "llm_model", "total_tokens"} {
+		if _, ok := raw.Turns[0][key]; !ok {
+			t.Errorf("Expected the exported turn to have %s, got %v", key, raw.Turns[0])
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package chunk
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type Strategy string
+
+const (
+	// None keeps the whole text as a single chunk
+	None Strategy = "none"
+	// Fixed cuts the text into windows of Size runes, each overlapping the previous one by Overlap runes
+	Fixed Strategy = "fixed"
+	// Paragraph packs blank line separated paragraphs into chunks of at most Size runes
+	Paragraph Strategy = "paragraph"
+	// Markdown cuts the text at headings and packs the sections into chunks of at most Size runes
+	Markdown Strategy = "markdown"
+)
+
+type Options struct {
+	Strategy Strategy
+	Size     int
+	Overlap  int
+}
+
+// Split divides text into chunks according to the options. An empty text results in a single empty chunk,
+// so that every document is represented by at least one fragment
+func Split(text string, opt Options) ([]string, error) {
+	if opt.Strategy != None && opt.Size <= 0 {
+		return nil, fmt.Errorf("chunk size must be positive, got %d", opt.Size)
+	}
+	if opt.Overlap < 0 || (opt.Strategy != None && opt.Overlap >= opt.Size) {
+		return nil, fmt.Errorf("chunk overlap must be in [0, %d), got %d", opt.Size, opt.Overlap)
+	}
+
+	var chunks []string
+	switch opt.Strategy {
+	case None, "":
+		chunks = []string{text}
+	case Fixed:
+		chunks = FixedSize(text, opt.Size, opt.Overlap)
+	case Paragraph:
+		chunks = Paragraphs(text, opt.Size, opt.Overlap)
+	case Markdown:
+		chunks = MarkdownSections(text, opt.Size, opt.Overlap)
+	default:
+		return nil, fmt.Errorf("unknown chunk strategy '%s'", opt.Strategy)
+	}
+
+	if len(chunks) == 0 {
+		chunks = []string{text}
+	}
+	return chunks, nil
+}
+
+// FixedSize cuts text into windows of size runes where each window starts overlap runes before the end of
+// the previous one. Cuts are moved back to the closest whitespace, if there is one in the latter half of the window
+func FixedSize(text string, size int, overlap int) []string {
+	runes := []rune(text)
+	if len(runes) <= size {
+		return []string{text}
+	}
+
+	var chunks []string
+	for start := 0; start < len(runes); {
+		end := min(start+size, len(runes))
+		if end < len(runes) {
+			for i := end; i > start+size/2; i-- {
+				if isSpace(runes[i-1]) {
+					end = i
+					break
+				}
+			}
+		}
+		chunks = append(chunks, string(runes[start:end]))
+		if end == len(runes) {
+			break
+		}
+		start = max(end-overlap, start+1)
+	}
+	return chunks
+}
+
+// Paragraphs packs paragraphs, separated by blank lines, into chunks of at most size runes.
+// Paragraphs that by them self are larger than size are cut using FixedSize. A text that fits in one chunk is
+// kept as it is, such that its fragment is unchanged by chunking and not embedded again
+func Paragraphs(text string, size int, overlap int) []string {
+	if utf8.RuneCountInString(text) <= size {
+		return []string{text}
+	}
+	return pack(paragraphs(text), "\n\n", size, overlap)
+}
+
+// MarkdownSections cuts text before every markdown heading, ignoring headings inside fenced code blocks,
+// and packs the sections into chunks of at most size runes. Sections larger than size are cut into paragraphs.
+// Like Paragraphs, a text that fits in one chunk is kept as it is
+func MarkdownSections(text string, size int, overlap int) []string {
+	if utf8.RuneCountInString(text) <= size {
+		return []string{text}
+	}
+	var sections []string
+	var section strings.Builder
+	var fenced bool
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fenced = !fenced
+		}
+		if !fenced && strings.HasPrefix(trimmed, "#") && section.Len() > 0 {
+			sections = append(sections, strings.TrimSpace(section.String()))
+			section.Reset()
+		}
+		section.WriteString(line)
+	}
+	if strings.TrimSpace(section.String()) != "" {
+		sections = append(sections, strings.TrimSpace(section.String()))
+	}
+
+	var units []string
+	for _, s := range sections {
+		if utf8.RuneCountInString(s) > size {
+			units = append(units, Paragraphs(s, size, overlap)...)
+			continue
+		}
+		units = append(units, s)
+	}
+	return pack(units, "\n\n", size, overlap)
+}
+
+func paragraphs(text string) []string {
+	var paras []string
+	var para strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if para.Len() > 0 {
+				paras = append(paras, para.String())
+				para.Reset()
+			}
+			continue
+		}
+		if para.Len() > 0 {
+			para.WriteString("\n")
+		}
+		para.WriteString(line)
+	}
+	if para.Len() > 0 {
+		paras = append(paras, para.String())
+	}
+	return paras
+}
+
+// pack greedily joins units with sep as long as the result fits within size runes
+func pack(units []string, sep string, size int, overlap int) []string {
+	var chunks []string
+	var cur []string
+	var curLen int
+
+	flush := func() {
+		if len(cur) > 0 {
+			chunks = append(chunks, strings.Join(cur, sep))
+			cur = nil
+			curLen = 0
+		}
+	}
+
+	for _, unit := range units {
+		l := utf8.RuneCountInString(unit)
+		if l > size {
+			flush()
+			chunks = append(chunks, FixedSize(unit, size, overlap)...)
+			continue
+		}
+		if len(cur) > 0 && curLen+len(sep)+l > size {
+			flush()
+		}
+		if len(cur) > 0 {
+			curLen += len(sep)
+		}
+		cur = append(cur, unit)
+		curLen += l
+	}
+	flush()
+
+	return chunks
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\n' || r == '\t' || r == '\r'
+}
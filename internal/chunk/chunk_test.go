@@ -0,0 +1,122 @@
+package chunk
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		opt    Options
+		want   []string
+		errMsg string
+	}{
+		{
+			name: "None keeps text",
+			text: "a b c",
+			opt:  Options{Strategy: None},
+			want: []string{"a b c"},
+		},
+		{
+			name: "Empty text is one chunk",
+			text: "",
+			opt:  Options{Strategy: Paragraph, Size: 10},
+			want: []string{""},
+		},
+		{
+			name: "Small text is not split",
+			text: "short",
+			opt:  Options{Strategy: Fixed, Size: 10},
+			want: []string{"short"},
+		},
+		{
+			name: "Small text keeps its blank lines",
+			text: "aaaa\n\n\n\nbbbb\n\n",
+			opt:  Options{Strategy: Paragraph, Size: 100},
+			want: []string{"aaaa\n\n\n\nbbbb\n\n"},
+		},
+		{
+			name: "Small markdown keeps its blank lines",
+			text: "# Title\n\n\ntext\n",
+			opt:  Options{Strategy: Markdown, Size: 100},
+			want: []string{"# Title\n\n\ntext\n"},
+		},
+		{
+			name: "Paragraphs are packed",
+			text: "aaaa\n\nbbbb\n\ncccc",
+			opt:  Options{Strategy: Paragraph, Size: 10},
+			want: []string{"aaaa\n\nbbbb", "cccc"},
+		},
+		{
+			name: "Markdown cuts at headings",
+			text: "# One\nfirst\n# Two\nsecond",
+			opt:  Options{Strategy: Markdown, Size: 12},
+			want: []string{"# One\nfirst", "# Two\nsecond"},
+		},
+		{
+			name: "Markdown ignores headings in code fences",
+			text: "# One\n```\n# not a heading\n```\n# Two\ntext",
+			opt:  Options{Strategy: Markdown, Size: 30},
+			want: []string{"# One\n```\n# not a heading\n```", "# Two\ntext"},
+		},
+		{
+			name:   "Unknown strategy",
+			text:   "a",
+			opt:    Options{Strategy: "words", Size: 10},
+			errMsg: "unknown chunk strategy 'words'",
+		},
+		{
+			name:   "Overlap larger than size",
+			text:   "a",
+			opt:    Options{Strategy: Fixed, Size: 10, Overlap: 10},
+			errMsg: "chunk overlap must be in [0, 10), got 10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Split(tt.text, tt.opt)
+			if tt.errMsg != "" {
+				if err == nil || err.Error() != tt.errMsg {
+					t.Errorf("Expected error %q, got %v", tt.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFixedSizeOverlap(t *testing.T) {
+	text := strings.Repeat("word ", 100)
+
+	chunks := FixedSize(text, 50, 10)
+	if len(chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(chunks))
+	}
+
+	for i, c := range chunks {
+		if l := utf8.RuneCountInString(c); l > 50 {
+			t.Errorf("Chunk %d has length %d, exceeding size 50", i, l)
+		}
+		if i > 0 {
+			prev := chunks[i-1]
+			if !strings.HasPrefix(c, prev[len(prev)-10:]) {
+				t.Errorf("Chunk %d does not overlap with the previous chunk", i)
+			}
+		}
+	}
+
+	if !strings.HasSuffix(text, chunks[len(chunks)-1]) {
+		t.Errorf("Last chunk does not end the text")
+	}
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/modfin/blot/internal/db/vec"
+	"strings"
+)
+
+type Centroid struct {
+	ID     int       `db:"id" json:"id"`
+	Vector []float64 `db:"vector" json:"vector"`
+}
+
+type FragmentVector struct {
+	ID     int       `db:"id" json:"id"`
+	Vector []float64 `db:"embedding_vector" json:"embedding_vector"`
+}
+
+func (q *Queries) Centroids(ctx context.Context, embeddingModel string) ([]Centroid, error) {
+
+	const centroids = `
+SELECT id, vector
+FROM ann_centroids
+WHERE embedding_model = ?
+ORDER BY id
+`
+
+	rows, err := q.db.QueryContext(ctx, centroids, embeddingModel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Centroid
+	for rows.Next() {
+		var i Centroid
+		var vecbin []byte
+		if err := rows.Scan(&i.ID, &vecbin); err != nil {
+			return nil, err
+		}
+		i.Vector, err = vec.Decode(vecbin)
+		if err != nil {
+			return nil, fmt.Errorf("decoding centroid vector: %w", err)
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (q *Queries) AddCentroid(ctx context.Context, embeddingModel string, vector []float64) (int, error) {
+
+	const addCentroid = `
+INSERT INTO ann_centroids (embedding_model, vector)
+VALUES (?, ?)
+RETURNING id
+`
+
+	var id int
+	err := q.db.QueryRowContext(ctx, addCentroid, embeddingModel, vec.Encode(vector, vec.Float64)).Scan(&id)
+	return id, err
+}
+
+// DeleteCentroids drops the index of an embedding model, including the lists of fragments
+func (q *Queries) DeleteCentroids(ctx context.Context, embeddingModel string) error {
+
+	const deleteLists = `
+DELETE FROM ann_lists
+WHERE centroid_id IN (SELECT id FROM ann_centroids WHERE embedding_model = ?)
+`
+	const deleteCentroids = `
+DELETE FROM ann_centroids
+WHERE embedding_model = ?
+`
+
+	_, err := q.db.ExecContext(ctx, deleteLists, embeddingModel)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.ExecContext(ctx, deleteCentroids, embeddingModel)
+	return err
+}
+
+func (q *Queries) AssignFragment(ctx context.Context, fragmentID int, centroidID int) error {
+
+	const assignFragment = `
+INSERT INTO ann_lists (fragment_id, centroid_id)
+VALUES (?, ?)
+ON CONFLICT (fragment_id) DO
+	UPDATE SET centroid_id = excluded.centroid_id
+`
+
+	_, err := q.db.ExecContext(ctx, assignFragment, fragmentID, centroidID)
+	return err
+}
+
+func (q *Queries) CountFragments(ctx context.Context, embeddingModel string) (int, error) {
+
+	const countFragments = `
+SELECT count(*)
+FROM fragments
+WHERE embedding_model = ?
+`
+
+	var count int
+	err := q.db.QueryRowContext(ctx, countFragments, embeddingModel).Scan(&count)
+	return count, err
+}
+
+// FragmentVectors returns a page of the vectors of an embedding model, ordered by id and starting after the given id
+func (q *Queries) FragmentVectors(ctx context.Context, embeddingModel string, afterID int, limit int) ([]FragmentVector, error) {
+
+	const fragmentVectors = `
+SELECT id, embedding_vector
+FROM fragments
+WHERE embedding_model = ? AND id > ?
+ORDER BY id
+LIMIT ?
+`
+
+	return q.fragmentVectors(ctx, fragmentVectors, embeddingModel, afterID, limit)
+}
+
+// SampleFragmentVectors returns a random sample of at most n vectors of an embedding model
+func (q *Queries) SampleFragmentVectors(ctx context.Context, embeddingModel string, n int) ([]FragmentVector, error) {
+
+	const sampleFragmentVectors = `
+SELECT id, embedding_vector
+FROM fragments
+WHERE embedding_model = ?
+ORDER BY random()
+LIMIT ?
+`
+
+	return q.fragmentVectors(ctx, sampleFragmentVectors, embeddingModel, n)
+}
+
+func (q *Queries) fragmentVectors(ctx context.Context, query string, args ...any) ([]FragmentVector, error) {
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []FragmentVector
+	for rows.Next() {
+		var i FragmentVector
+		var vecbin []byte
+		if err := rows.Scan(&i.ID, &vecbin); err != nil {
+			return nil, err
+		}
+		i.Vector, err = vec.Decode(vecbin)
+		if err != nil {
+			return nil, fmt.Errorf("decoding embedding vector: %w", err)
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+type ANNParams struct {
+	Vector    []float64
+	Label     string
+	Centroids []int
+	Metric    vec.Metric
+	Limit     int
+}
+
+// ANN is KNN restricted to the fragments in the lists of the given centroids, scored by the metric
+func (q *Queries) ANN(ctx context.Context, arg ANNParams) ([]Fragment, error) {
+
+	const aNN = `
+SELECT id, label, name, document, chunk_index, content, embedding_model, embedding_vector, created_at, updated_at,
+	%s(?, embedding_vector) AS distance
+FROM fragments
+WHERE label like ? 
+  AND id IN (SELECT fragment_id FROM ann_lists WHERE centroid_id IN (%s))
+ORDER BY distance
+LIMIT ?
+`
+
+	if len(arg.Centroids) == 0 {
+		return nil, nil
+	}
+	metric, err := vec.ParseMetric(string(arg.Metric))
+	if err != nil {
+		return nil, err
+	}
+
+	args := []any{vec.Encode(arg.Vector, vec.Float64), arg.Label}
+	for _, c := range arg.Centroids {
+		args = append(args, c)
+	}
+	args = append(args, arg.Limit)
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(arg.Centroids)), ",")
+
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(aNN, metric.Function(), placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Fragment
+	for rows.Next() {
+		var distance float64
+		i, err := scanFragment(rows, &distance)
+		if err != nil {
+			return nil, err
+		}
+		i.Score = metric.Score(distance)
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"github.com/modfin/blot/internal/db/vec"
+)
+
+// CachedEmbedding returns the cached vector of the content hash, or sql.ErrNoRows if it has not been cached
+func (q *Queries) CachedEmbedding(ctx context.Context, model string, typ string, hash string) ([]float64, error) {
+
+	const cachedEmbedding = `
+SELECT vector
+FROM embedding_cache
+WHERE embedding_model = ? AND embedding_type = ? AND content_hash = ?
+`
+
+	var data []byte
+	err := q.db.QueryRowContext(ctx, cachedEmbedding, model, typ, hash).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+	return vec.Decode(data)
+}
+
+// CacheEmbedding caches the vector of the content hash, stored as float32 which is the precision of embedding apis
+func (q *Queries) CacheEmbedding(ctx context.Context, model string, typ string, hash string, vector []float64) error {
+
+	const cacheEmbedding = `
+INSERT INTO embedding_cache (embedding_model, embedding_type, content_hash, vector)
+VALUES (?, ?, ?, ?)
+ON CONFLICT DO UPDATE SET vector = excluded.vector, created_at = excluded.created_at
+`
+
+	_, err := q.db.ExecContext(ctx, cacheEmbedding, model, typ, hash, vec.Encode(vector, vec.Float32))
+	return err
+}
+
+type EmbeddingCacheStat struct {
+	EmbeddingModel string `db:"embedding_model" json:"embedding_model"`
+	Entries        int    `db:"entries" json:"entries"`
+	Bytes          int    `db:"bytes" json:"bytes"`
+	OldestAt       int    `db:"oldest_at" json:"oldest_at"`
+	NewestAt       int    `db:"newest_at" json:"newest_at"`
+}
+
+// EmbeddingCacheStats returns the number of cached embeddings, and the size of their vectors, per embedding model
+func (q *Queries) EmbeddingCacheStats(ctx context.Context) ([]EmbeddingCacheStat, error) {
+
+	const embeddingCacheStats = `
+SELECT embedding_model, count(*), coalesce(sum(length(vector)), 0), min(created_at), max(created_at)
+FROM embedding_cache
+GROUP BY embedding_model
+ORDER BY embedding_model
+`
+
+	rows, err := q.db.QueryContext(ctx, embeddingCacheStats)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []EmbeddingCacheStat
+	for rows.Next() {
+		var i EmbeddingCacheStat
+		if err := rows.Scan(&i.EmbeddingModel, &i.Entries, &i.Bytes, &i.OldestAt, &i.NewestAt); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// ClearEmbeddingCache deletes the cached embeddings of the model, or of all models if it is empty, returning the
+// number of deleted embeddings
+func (q *Queries) ClearEmbeddingCache(ctx context.Context, model string) (int64, error) {
+
+	const clearEmbeddingCache = `
+DELETE FROM embedding_cache
+WHERE ? = '' OR embedding_model = ?
+`
+
+	res, err := q.db.ExecContext(ctx, clearEmbeddingCache, model, model)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// LexicalSearch ranks fragments by bm25 using the full text index. Every term in text is matched as a quoted
+// phrase, so that control ids such as "A.9.2.3" are matched as a sequence of tokens, and any term may match.
+// Only fragments embedded by the model are searched, so that a document embedded by several models is found once
+func (q *Queries) LexicalSearch(ctx context.Context, text string, embeddingModel string, label string, limit int) ([]Fragment, error) {
+
+	const lexicalSearch = `
+SELECT f.id, f.label, f.name, f.document, f.chunk_index, f.content, f.embedding_model, f.embedding_vector, f.created_at, f.updated_at,
+	bm25(fragments_fts) AS rank
+FROM fragments_fts
+	JOIN fragments f ON f.id = fragments_fts.rowid
+WHERE fragments_fts MATCH ? AND f.embedding_model = ? AND f.label like ?
+ORDER BY rank
+LIMIT ?
+`
+
+	match := matchExpression(text)
+	if match == "" {
+		return nil, nil
+	}
+
+	rows, err := q.db.QueryContext(ctx, lexicalSearch,
+		match,
+		embeddingModel,
+		label,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Fragment
+	for rows.Next() {
+		var rank float64
+		i, err := scanFragment(rows, &rank)
+		if err != nil {
+			return nil, err
+		}
+		i.Score = -rank // bm25 is negative, where lower is better
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// matchExpression turns free text into a fts5 query where each term is a quoted phrase, joined by OR
+func matchExpression(text string) string {
+	var terms []string
+	for _, term := range strings.Fields(text) {
+		term = strings.TrimFunc(term, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		if term == "" {
+			continue
+		}
+		terms = append(terms, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " OR ")
+}
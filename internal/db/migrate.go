@@ -0,0 +1,339 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/modfin/blot/internal/db/vec"
+)
+
+// migration takes the database from one version to the next. Migrations are applied in order, within a
+// transaction, and the version is tracked using sqlite's user_version pragma
+type migration func(ctx context.Context, tx *sql.Tx) error
+
+func statements(stmts ...string) migration {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			_, err := tx.ExecContext(ctx, stmt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+var migrations = []migration{
+	// 1. documents split into several chunks
+	statements(
+		`ALTER TABLE fragments ADD COLUMN document TEXT`,
+		`ALTER TABLE fragments ADD COLUMN chunk_index INTEGER DEFAULT 0`,
+		`UPDATE fragments SET document = name, chunk_index = 0 WHERE document IS NULL`,
+		`CREATE INDEX IF NOT EXISTS fragments_label_document ON fragments (label, document)`,
+	),
+	// 2. full text index of fragments, kept in sync by triggers
+	statements(
+		`CREATE VIRTUAL TABLE IF NOT EXISTS fragments_fts USING fts5(name, content, content='fragments', content_rowid='id')`,
+		ftsTriggers,
+		`INSERT INTO fragments_fts(fragments_fts) VALUES ('rebuild')`,
+	),
+	// 3. inverted file index, for approximate nearest neighbour search
+	statements(
+		`CREATE TABLE IF NOT EXISTS ann_centroids
+(
+    id INTEGER PRIMARY KEY,
+    embedding_model TEXT,
+    vector BLOB
+)`,
+		`CREATE INDEX IF NOT EXISTS ann_centroids_model ON ann_centroids (embedding_model)`,
+		`CREATE TABLE IF NOT EXISTS ann_lists
+(
+    fragment_id INTEGER PRIMARY KEY,
+    centroid_id INTEGER
+)`,
+		`CREATE INDEX IF NOT EXISTS ann_lists_centroid ON ann_lists (centroid_id)`,
+		annTriggers,
+	),
+	// 4. several embedding models in one database, where each document may be embedded once per model.
+	// sqlite can not alter constraints so the table is rebuilt, keeping ids, which drops its triggers
+	statements(
+		`CREATE TABLE fragments_new
+(
+    id   INTEGER PRIMARY KEY,
+
+    label TEXT DEFAULT 'default',
+
+    name TEXT,
+    document TEXT,
+    chunk_index INTEGER DEFAULT 0,
+    content TEXT,
+
+    embedding_model TEXT,
+    embedding_vector BLOB,
+
+    created_at INTEGER DEFAULT (strftime('%s', 'now')),
+    updated_at INTEGER DEFAULT (strftime('%s', 'now')),
+
+    CONSTRAINT unique_label_name_model UNIQUE (label, name, embedding_model)
+)`,
+		`INSERT INTO fragments_new (id, label, name, document, chunk_index, content, embedding_model, embedding_vector, created_at, updated_at)
+SELECT id, label, name, document, chunk_index, content, embedding_model, embedding_vector, created_at, updated_at
+FROM fragments`,
+		`DROP TABLE fragments`,
+		`ALTER TABLE fragments_new RENAME TO fragments`,
+		`CREATE INDEX IF NOT EXISTS fragments_label_document ON fragments (label, document)`,
+		`CREATE INDEX IF NOT EXISTS fragments_embedding_model ON fragments (embedding_model)`,
+		ftsTriggers,
+		annTriggers,
+	),
+	// 5. vectors encoded with a header identifying the encoding. Updating vectors should not touch the full text
+	// index, so its update trigger is limited to the indexed columns
+	statements(
+		`DROP TRIGGER IF EXISTS fragments_fts_update`,
+		ftsUpdateTrigger,
+	),
+	encodeVectors,
+	// 7. settings of the knowledge base per embedding model, such as the distance metric
+	statements(
+		`CREATE TABLE IF NOT EXISTS embedding_models
+(
+    embedding_model TEXT PRIMARY KEY,
+    metric TEXT
+)`,
+	),
+	// 8. chat sessions, persisted between invocations, with the turns of each
+	statements(
+		`CREATE TABLE IF NOT EXISTS sessions
+(
+    id INTEGER PRIMARY KEY,
+    name TEXT UNIQUE,
+
+    created_at INTEGER DEFAULT (strftime('%s', 'now')),
+    updated_at INTEGER DEFAULT (strftime('%s', 'now'))
+)`,
+		`CREATE TABLE IF NOT EXISTS session_turns
+(
+    id INTEGER PRIMARY KEY,
+    session_id INTEGER,
+
+    question TEXT,
+    query TEXT,
+    answer TEXT,
+    confidence REAL,
+    sources TEXT,
+    fragment_ids TEXT,
+
+    llm_model TEXT,
+    input_tokens INTEGER,
+    output_tokens INTEGER,
+    total_tokens INTEGER,
+
+    created_at INTEGER DEFAULT (strftime('%s', 'now'))
+)`,
+		`CREATE INDEX IF NOT EXISTS session_turns_session ON session_turns (session_id)`,
+	),
+	// 9. cache of embedded questions, such that the same text is only embedded once per model
+	statements(
+		`CREATE TABLE IF NOT EXISTS embedding_cache
+(
+    embedding_model TEXT,
+    embedding_type TEXT,
+    content_hash TEXT,
+    vector BLOB,
+
+    created_at INTEGER DEFAULT (strftime('%s', 'now')),
+
+    PRIMARY KEY (embedding_model, embedding_type, content_hash)
+) WITHOUT ROWID`,
+	),
+	// 10. ledger of the tokens used, and their cost, by every request to a model, and the prices of models
+	statements(
+		`CREATE TABLE IF NOT EXISTS usage_ledger
+(
+    id INTEGER PRIMARY KEY,
+    command TEXT,
+    kind TEXT,
+    model TEXT,
+
+    input_tokens INTEGER,
+    output_tokens INTEGER,
+    total_tokens INTEGER,
+    cost REAL,
+    latency_ms INTEGER,
+
+    created_at INTEGER DEFAULT (strftime('%s', 'now'))
+)`,
+		`CREATE INDEX IF NOT EXISTS usage_ledger_created_at ON usage_ledger (created_at)`,
+		`CREATE TABLE IF NOT EXISTS model_prices
+(
+    model TEXT PRIMARY KEY,
+    input_price REAL,
+    output_price REAL,
+
+    updated_at INTEGER DEFAULT (strftime('%s', 'now'))
+)`,
+		// list prices in USD per million tokens, which are kept up to date using the usage prices command
+		`INSERT INTO model_prices (model, input_price, output_price)
+VALUES ('OpenAI/gpt-4o-mini', 0.15, 0.60),
+       ('OpenAI/gpt-4o', 2.50, 10.00),
+       ('OpenAI/gpt-4.1', 2.00, 8.00),
+       ('OpenAI/gpt-4.1-mini', 0.40, 1.60),
+       ('OpenAI/gpt-4.1-nano', 0.10, 0.40),
+       ('OpenAI/o3-mini', 1.10, 4.40),
+       ('OpenAI/text-embedding-3-small', 0.02, 0),
+       ('OpenAI/text-embedding-3-large', 0.13, 0),
+       ('OpenAI/text-embedding-ada-002', 0.10, 0),
+       ('Anthropic/claude-3-5-haiku-latest', 0.80, 4.00),
+       ('Anthropic/claude-3-5-sonnet-latest', 3.00, 15.00),
+       ('Anthropic/claude-3-7-sonnet-latest', 3.00, 15.00),
+       ('Anthropic/claude-3-opus-latest', 15.00, 75.00),
+       ('VertexAI/gemini-2.0-flash-001', 0.15, 0.60),
+       ('VertexAI/gemini-2.0-flash-lite-001', 0.075, 0.30),
+       ('VoyageAI/voyage-3', 0.06, 0),
+       ('VoyageAI/voyage-3-lite', 0.02, 0),
+       ('VoyageAI/voyage-3-large', 0.18, 0),
+       ('VoyageAI/voyage-law-2', 0.12, 0),
+       ('VoyageAI/rerank-2', 0.05, 0),
+       ('VoyageAI/rerank-2-lite', 0.02, 0)
+ON CONFLICT DO NOTHING`,
+	),
+	// 11. requests that failed are kept in the ledger, with their error
+	statements(
+		`ALTER TABLE usage_ledger ADD COLUMN error TEXT`,
+	),
+}
+
+// encodeVectors converts vectors stored as raw float64, without header, to the encoded format. Fragments are
+// stored as float32, the precision that embedding apis return, while centroids are kept as float64
+func encodeVectors(ctx context.Context, tx *sql.Tx) error {
+	type blob struct {
+		id   int
+		data []byte
+	}
+	read := func(query string, args ...any) ([]blob, error) {
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var blobs []blob
+		for rows.Next() {
+			var b blob
+			if err := rows.Scan(&b.id, &b.data); err != nil {
+				return nil, err
+			}
+			blobs = append(blobs, b)
+		}
+		return blobs, rows.Err()
+	}
+	convert := func(update string, blobs []blob, enc vec.Encoding) error {
+		for _, b := range blobs {
+			v, err := vec.DecodeVector(b.data)
+			if err != nil {
+				return fmt.Errorf("decoding legacy vector %d: %w", b.id, err)
+			}
+			_, err = tx.ExecContext(ctx, update, vec.Encode(v, enc), b.id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for after := 0; ; {
+		page, err := read(`SELECT id, embedding_vector FROM fragments WHERE id > ? ORDER BY id LIMIT 1000`, after)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		err = convert(`UPDATE fragments SET embedding_vector = ? WHERE id = ?`, page, vec.Float32)
+		if err != nil {
+			return err
+		}
+		after = page[len(page)-1].id
+	}
+
+	centroids, err := read(`SELECT id, vector FROM ann_centroids`)
+	if err != nil {
+		return err
+	}
+	return convert(`UPDATE ann_centroids SET vector = ? WHERE id = ?`, centroids, vec.Float64)
+}
+
+const annTriggers = `
+CREATE TRIGGER IF NOT EXISTS ann_lists_delete AFTER DELETE ON fragments BEGIN
+	DELETE FROM ann_lists WHERE fragment_id = old.id;
+END;
+`
+
+const ftsTriggers = `
+CREATE TRIGGER IF NOT EXISTS fragments_fts_insert AFTER INSERT ON fragments BEGIN
+	INSERT INTO fragments_fts (rowid, name, content) VALUES (new.id, new.name, new.content);
+END;
+CREATE TRIGGER IF NOT EXISTS fragments_fts_delete AFTER DELETE ON fragments BEGIN
+	INSERT INTO fragments_fts (fragments_fts, rowid, name, content) VALUES ('delete', old.id, old.name, old.content);
+END;
+CREATE TRIGGER IF NOT EXISTS fragments_fts_update AFTER UPDATE ON fragments BEGIN
+	INSERT INTO fragments_fts (fragments_fts, rowid, name, content) VALUES ('delete', old.id, old.name, old.content);
+	INSERT INTO fragments_fts (rowid, name, content) VALUES (new.id, new.name, new.content);
+END;
+`
+
+const ftsUpdateTrigger = `
+CREATE TRIGGER IF NOT EXISTS fragments_fts_update AFTER UPDATE OF name, content ON fragments BEGIN
+	INSERT INTO fragments_fts (fragments_fts, rowid, name, content) VALUES ('delete', old.id, old.name, old.content);
+	INSERT INTO fragments_fts (rowid, name, content) VALUES (new.id, new.name, new.content);
+END;
+`
+
+// Open opens the sqlite database of the dsn, creating the schema and migrating it to the latest version
+func Open(ctx context.Context, dsn string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.ExecContext(ctx, Schema)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("create schema: %w", err)
+	}
+	err = Migrate(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func Migrate(ctx context.Context, conn *sql.DB) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		err = migrations[i](ctx, tx)
+		if err != nil {
+			return fmt.Errorf("migrating schema to version %d: %w", i+1, err)
+		}
+	}
+	if version >= len(migrations) {
+		return nil
+	}
+
+	// pragmas does not take parameters
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, len(migrations)))
+	if err != nil {
+		return fmt.Errorf("write schema version: %w", err)
+	}
+	return tx.Commit()
+}
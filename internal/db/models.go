@@ -5,12 +5,16 @@
 package db
 
 type Fragment struct {
-	ID              int     `db:"id" json:"id"`
+	ID              int       `db:"id" json:"id"`
 	Label           string    `db:"label" json:"label"`
 	Name            string    `db:"name" json:"name"`
+	Document        string    `db:"document" json:"document"`
+	ChunkIndex      int       `db:"chunk_index" json:"chunk_index"`
 	Content         string    `db:"content" json:"content"`
 	EmbeddingModel  string    `db:"embedding_model" json:"embedding_model"`
 	EmbeddingVector []float64 `db:"embedding_vector" json:"embedding_vector"`
-	CreatedAt       int     `db:"created_at" json:"created_at"`
-	UpdatedAt       int     `db:"updated_at" json:"updated_at"`
+	CreatedAt       int       `db:"created_at" json:"created_at"`
+	UpdatedAt       int       `db:"updated_at" json:"updated_at"`
+	// Score is how relevant the fragment is to a search, where higher is better. It is only set by searches
+	Score float64 `db:"score" json:"score"`
 }
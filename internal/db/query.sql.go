@@ -2,95 +2,181 @@ package db
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/modfin/blot/internal/db/vec"
+	"strings"
 )
 
-func (q *Queries) AddFragment(
-	ctx context.Context,
-	label string,
-	name string,
-	content string,
-	embeddingModel string,
-	embeddingVector []float64,
-) (Fragment, error) {
-
-	const addFragment = `
-INSERT INTO fragments (label, name, content, embedding_model, embedding_vector)
-VALUES (?, ?, ?, ?, ?) 
-ON CONFLICT (label, name) DO 
-	UPDATE 
-    SET content = excluded.content, 
-		embedding_model = excluded.embedding_model,
-		embedding_vector = excluded.embedding_vector
-RETURNING id, label, name, content, embedding_model, embedding_vector, created_at, updated_at
-`
-
-	row := q.db.QueryRowContext(ctx, addFragment,
-		label,
-		name,
-		content,
-		embeddingModel,
-		vec.EncodeVector(embeddingVector),
-	)
+type scanner interface {
+	Scan(dest ...any) error
+}
 
+// scanFragment scans a row selected with the columns
+// id, label, name, document, chunk_index, content, embedding_model, embedding_vector, created_at, updated_at.
+// The embedding vector may be selected as NULL, leaving it empty, when it is not needed. Any extra columns
+// following them are scanned into extra
+func scanFragment(row scanner, extra ...any) (Fragment, error) {
 	var i Fragment
 	var vecbin []byte
-	err := row.Scan(
+	err := row.Scan(append([]any{
 		&i.ID,
 		&i.Label,
 		&i.Name,
+		&i.Document,
+		&i.ChunkIndex,
 		&i.Content,
 		&i.EmbeddingModel,
 		&vecbin,
 		&i.CreatedAt,
 		&i.UpdatedAt,
-	)
+	}, extra...)...)
 	if err != nil {
-		return Fragment{}, fmt.Errorf("insert fragment: %w", err)
+		return Fragment{}, err
+	}
+	if vecbin == nil {
+		return i, nil // the vector was not selected
 	}
-	i.EmbeddingVector, err = vec.DecodeVector(vecbin)
+	i.EmbeddingVector, err = vec.Decode(vecbin)
 	if err != nil {
 		return Fragment{}, fmt.Errorf("decoding embedding vector: %w", err)
 	}
-	return i, err
+	return i, nil
+}
+
+type AddFragmentParams struct {
+	Label           string
+	Name            string
+	Document        string
+	ChunkIndex      int
+	Content         string
+	EmbeddingModel  string
+	EmbeddingVector []float64
+	// Encoding of the stored vector, which may be lossy
+	Encoding vec.Encoding
+}
+
+func (q *Queries) AddFragment(ctx context.Context, arg AddFragmentParams) (Fragment, error) {
+
+	const addFragment = `
+INSERT INTO fragments (label, name, document, chunk_index, content, embedding_model, embedding_vector)
+VALUES (?, ?, ?, ?, ?, ?, ?) 
+ON CONFLICT (label, name, embedding_model) DO 
+	UPDATE 
+    SET document = excluded.document,
+		chunk_index = excluded.chunk_index,
+		content = excluded.content, 
+		embedding_vector = excluded.embedding_vector
+RETURNING id, label, name, document, chunk_index, content, embedding_model, embedding_vector, created_at, updated_at
+`
+
+	row := q.db.QueryRowContext(ctx, addFragment,
+		arg.Label,
+		arg.Name,
+		arg.Document,
+		arg.ChunkIndex,
+		arg.Content,
+		arg.EmbeddingModel,
+		vec.Encode(arg.EmbeddingVector, arg.Encoding),
+	)
+
+	i, err := scanFragment(row)
+	if err != nil {
+		return Fragment{}, fmt.Errorf("insert fragment: %w", err)
+	}
+	return i, nil
 }
 
-func (q *Queries) DirtyFragment(ctx context.Context, label string, name string, content string) (bool, error) {
+// DirtyFragment reports whether the stored chunks of a document, embedded by the model, differs from the given
+// ones, ie. if the document is new, has changed or has been chunked differently
+func (q *Queries) DirtyFragment(ctx context.Context, label string, document string, embeddingModel string, chunks []string) (bool, error) {
 
 	const dirty = `
-	SELECT count(*) = 0
+	SELECT content
 	FROM fragments
-	WHERE label = ? AND name = ? AND content = ?
+	WHERE label = ? AND document = ? AND embedding_model = ?
+	ORDER BY chunk_index
 `
 
-	row := q.db.QueryRowContext(ctx, dirty,
+	rows, err := q.db.QueryContext(ctx, dirty,
 		label,
-		name,
-		content,
+		document,
+		embeddingModel,
 	)
-	var i bool
-	if err := row.Scan(&i); err != nil {
+	if err != nil {
 		return false, err
 	}
-	return i, nil
+	defer rows.Close()
+
+	var i int
+	for ; rows.Next(); i++ {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			return false, err
+		}
+		if i >= len(chunks) || chunks[i] != content {
+			return true, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	return i != len(chunks), nil
 
 }
 
-func (q *Queries) KNN(ctx context.Context, vector []float64, label string, limit int) ([]Fragment, error) {
+// DeleteDocument removes all chunks of a document embedded by the model
+func (q *Queries) DeleteDocument(ctx context.Context, label string, document string, embeddingModel string) (int64, error) {
 
+	const deleteDocument = `
+DELETE FROM fragments
+WHERE label = ? AND document = ? AND embedding_model = ?
+`
+
+	res, err := q.db.ExecContext(ctx, deleteDocument,
+		label,
+		document,
+		embeddingModel,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type KNNParams struct {
+	Vector         []float64
+	EmbeddingModel string
+	Label          string
+	Metric         vec.Metric
+	Limit          int
+}
+
+// KNN ranks the fragments embedded by the model by their distance to vector, scored by the metric. Vectors of
+// different models are never compared, since they do not share a vector space and may not even share dimensions
+func (q *Queries) KNN(ctx context.Context, arg KNNParams) ([]Fragment, error) {
+
+	// the metric is not a parameter but the name of the distance function
 	const kNN = `
-SELECT id, label, name, content, embedding_model, embedding_vector, created_at, updated_at
+SELECT id, label, name, document, chunk_index, content, embedding_model, embedding_vector, created_at, updated_at,
+	%s(?, embedding_vector) AS distance
 FROM fragments
-WHERE label like ?
-ORDER BY vec_dist(?, embedding_vector)
+WHERE embedding_model = ? AND label like ?
+ORDER BY distance
 LIMIT ?
 `
 
-	rows, err := q.db.QueryContext(ctx, kNN,
-		label,
-		vec.EncodeVector(vector),
-		limit,
+	metric, err := vec.ParseMetric(string(arg.Metric))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(kNN, metric.Function()),
+		vec.Encode(arg.Vector, vec.Float64),
+		arg.EmbeddingModel,
+		arg.Label,
+		arg.Limit,
 	)
 	if err != nil {
 		return nil, err
@@ -98,24 +184,55 @@ LIMIT ?
 	defer rows.Close()
 	var items []Fragment
 	for rows.Next() {
-		var i Fragment
-		var vecbytes []byte
-		if err := rows.Scan(
-			&i.ID,
-			&i.Label,
-			&i.Name,
-			&i.Content,
-			&i.EmbeddingModel,
-			&vecbytes,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-		); err != nil {
+		var distance float64
+		i, err := scanFragment(rows, &distance)
+		if err != nil {
 			return nil, err
 		}
+		i.Score = metric.Score(distance)
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
 
-		i.EmbeddingVector, err = vec.DecodeVector(vecbytes)
+type ListFragmentsParams struct {
+	// Label filters on label, if set
+	Label string
+	// Name filters on a glob pattern matching either the fragment name or its document, if set
+	Name string
+}
+
+// ListFragments lists fragments without their embedding vectors
+func (q *Queries) ListFragments(ctx context.Context, arg ListFragmentsParams) ([]Fragment, error) {
+
+	// the embedding vector is selected as null, since decoding every vector is costly and not needed
+	const listFragments = `
+SELECT id, label, name, document, chunk_index, content, embedding_model, NULL AS embedding_vector, created_at, updated_at
+FROM fragments
+WHERE (? = '' OR label = ?)
+  AND (? = '' OR name GLOB ? OR document GLOB ?)
+ORDER BY label, document, chunk_index, id
+`
+
+	rows, err := q.db.QueryContext(ctx, listFragments,
+		arg.Label, arg.Label,
+		arg.Name, arg.Name, arg.Name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Fragment
+	for rows.Next() {
+		i, err := scanFragment(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed decoding embedding vector: %w", err)
+			return nil, err
 		}
 		items = append(items, i)
 	}
@@ -128,31 +245,78 @@ LIMIT ?
 	return items, nil
 }
 
-func (q *Queries) ListFragments(ctx context.Context) ([]Fragment, error) {
+func (q *Queries) GetFragment(ctx context.Context, id int) (Fragment, error) {
 
-	const listFragments = `
-SELECT id, label, name, content, embedding_model, embedding_vector, created_at
+	const getFragment = `
+SELECT id, label, name, document, chunk_index, content, embedding_model, embedding_vector, created_at, updated_at
 FROM fragments
-ORDER BY id
+WHERE id = ?
 `
 
-	rows, err := q.db.QueryContext(ctx, listFragments)
+	return scanFragment(q.db.QueryRowContext(ctx, getFragment, id))
+}
+
+type DeleteFragmentsParams struct {
+	IDs   []int
+	Label string
+	// Name matches either the fragment name or its document, as a glob pattern
+	Name string
+}
+
+// DeleteFragments removes the fragments matching all of the given filters, at least one filter must be set
+func (q *Queries) DeleteFragments(ctx context.Context, arg DeleteFragmentsParams) (int64, error) {
+
+	var where []string
+	var args []any
+	if len(arg.IDs) > 0 {
+		where = append(where, fmt.Sprintf("id IN (%s)", strings.TrimSuffix(strings.Repeat("?,", len(arg.IDs)), ",")))
+		for _, id := range arg.IDs {
+			args = append(args, id)
+		}
+	}
+	if arg.Label != "" {
+		where = append(where, "label = ?")
+		args = append(args, arg.Label)
+	}
+	if arg.Name != "" {
+		where = append(where, "(name GLOB ? OR document GLOB ?)")
+		args = append(args, arg.Name, arg.Name)
+	}
+	if len(where) == 0 {
+		return 0, fmt.Errorf("no filter given, refusing to delete all fragments")
+	}
+
+	res, err := q.db.ExecContext(ctx, "DELETE FROM fragments WHERE "+strings.Join(where, " AND "), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type LabelCount struct {
+	Label     string `db:"label" json:"label"`
+	Fragments int    `db:"fragments" json:"fragments"`
+	Documents int    `db:"documents" json:"documents"`
+}
+
+func (q *Queries) Labels(ctx context.Context) ([]LabelCount, error) {
+
+	const labels = `
+SELECT label, count(*) AS fragments, count(DISTINCT document) AS documents
+FROM fragments
+GROUP BY label
+ORDER BY label
+`
+
+	rows, err := q.db.QueryContext(ctx, labels)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []Fragment
+	var items []LabelCount
 	for rows.Next() {
-		var i Fragment
-		if err := rows.Scan(
-			&i.ID,
-			&i.Label,
-			&i.Name,
-			&i.Content,
-			&i.EmbeddingModel,
-			&i.EmbeddingVector,
-			&i.CreatedAt,
-		); err != nil {
+		var i LabelCount
+		if err := rows.Scan(&i.Label, &i.Fragments, &i.Documents); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -165,3 +329,129 @@ ORDER BY id
 	}
 	return items, nil
 }
+
+func (q *Queries) ListDocuments(ctx context.Context, label string, embeddingModel string) ([]string, error) {
+
+	const listDocuments = `
+SELECT DISTINCT document
+FROM fragments
+WHERE label = ? AND embedding_model = ?
+ORDER BY document
+`
+
+	rows, err := q.db.QueryContext(ctx, listDocuments, label, embeddingModel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			return nil, err
+		}
+		items = append(items, document)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+type ModelCount struct {
+	EmbeddingModel string `db:"embedding_model" json:"embedding_model"`
+	Fragments      int    `db:"fragments" json:"fragments"`
+	// Metric is the recorded distance metric of the model, if any
+	Metric vec.Metric `db:"metric" json:"metric"`
+}
+
+// HasEmbeddingModel reports whether there are any fragments embedded by the model
+func (q *Queries) HasEmbeddingModel(ctx context.Context, embeddingModel string) (bool, error) {
+
+	const hasEmbeddingModel = `
+SELECT EXISTS (SELECT 1 FROM fragments WHERE embedding_model = ?)
+`
+
+	var exists bool
+	err := q.db.QueryRowContext(ctx, hasEmbeddingModel, embeddingModel).Scan(&exists)
+	return exists, err
+}
+
+func (q *Queries) EmbeddingModels(ctx context.Context) ([]ModelCount, error) {
+
+	const embeddingModels = `
+SELECT f.embedding_model, count(*) AS fragments, coalesce(m.metric, '') AS metric
+FROM fragments f
+	LEFT JOIN embedding_models m ON m.embedding_model = f.embedding_model
+GROUP BY f.embedding_model
+ORDER BY fragments DESC, f.embedding_model
+`
+
+	rows, err := q.db.QueryContext(ctx, embeddingModels)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ModelCount
+	for rows.Next() {
+		var i ModelCount
+		if err := rows.Scan(&i.EmbeddingModel, &i.Fragments, &i.Metric); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// UpdateEmbeddingVector stores the vector of a fragment using another encoding
+func (q *Queries) UpdateEmbeddingVector(ctx context.Context, id int, vector []float64, encoding vec.Encoding) error {
+
+	const updateEmbeddingVector = `
+UPDATE fragments
+SET embedding_vector = ?
+WHERE id = ?
+`
+
+	_, err := q.db.ExecContext(ctx, updateEmbeddingVector, vec.Encode(vector, encoding), id)
+	return err
+}
+
+// Metric returns the distance metric recorded for the embedding model, or an empty metric if none is recorded
+func (q *Queries) Metric(ctx context.Context, embeddingModel string) (vec.Metric, error) {
+
+	const metric = `
+SELECT coalesce(metric, '')
+FROM embedding_models
+WHERE embedding_model = ?
+`
+
+	var m vec.Metric
+	err := q.db.QueryRowContext(ctx, metric, embeddingModel).Scan(&m)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return m, err
+}
+
+func (q *Queries) SetMetric(ctx context.Context, embeddingModel string, metric vec.Metric) error {
+
+	const setMetric = `
+INSERT INTO embedding_models (embedding_model, metric)
+VALUES (?, ?)
+ON CONFLICT (embedding_model) DO
+	UPDATE
+	SET metric = excluded.metric
+`
+
+	_, err := q.db.ExecContext(ctx, setMetric, embeddingModel, metric)
+	return err
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+)
+
+type PendingReembedParams struct {
+	From string
+	To   string
+	// Label filters on label, if set
+	Label   string
+	AfterID int
+	Limit   int
+}
+
+const pendingReembedWhere = `
+WHERE f.embedding_model = ?
+  AND (? = '' OR f.label = ?)
+  AND f.id > ?
+  AND NOT EXISTS (
+	SELECT 1 FROM fragments t
+	WHERE t.label = f.label AND t.name = f.name AND t.embedding_model = ? AND t.content = f.content
+  )
+`
+
+// PendingReembed pages through the fragments embedded by the From model that have no fragment with the same
+// label, name and content embedded by the To model. The embedding vectors are not selected
+func (q *Queries) PendingReembed(ctx context.Context, arg PendingReembedParams) ([]Fragment, error) {
+
+	const pendingReembed = `
+SELECT f.id, f.label, f.name, f.document, f.chunk_index, f.content, f.embedding_model, NULL AS embedding_vector, f.created_at, f.updated_at
+FROM fragments f` + pendingReembedWhere + `
+ORDER BY f.id
+LIMIT ?
+`
+
+	rows, err := q.db.QueryContext(ctx, pendingReembed,
+		arg.From,
+		arg.Label, arg.Label,
+		arg.AfterID,
+		arg.To,
+		arg.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Fragment
+	for rows.Next() {
+		i, err := scanFragment(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// CountPendingReembed counts the fragments PendingReembed would page through, ignoring AfterID and Limit
+func (q *Queries) CountPendingReembed(ctx context.Context, arg PendingReembedParams) (int, error) {
+
+	const countPendingReembed = `
+SELECT count(*)
+FROM fragments f` + pendingReembedWhere
+
+	var count int
+	err := q.db.QueryRowContext(ctx, countPendingReembed,
+		arg.From,
+		arg.Label, arg.Label,
+		0,
+		arg.To,
+	).Scan(&count)
+	return count, err
+}
+
+// DeleteStaleReembed removes the fragments embedded by the To model whose chunk index is at or above the number
+// of chunks of their document embedded by the From model, or whose name is not among those chunks, left behind
+// when the document was chunked into fewer fragments after it was re-embedded. Documents without fragments of the
+// From model are kept
+func (q *Queries) DeleteStaleReembed(ctx context.Context, arg PendingReembedParams) (int64, error) {
+
+	const deleteStaleReembed = `
+DELETE FROM fragments
+WHERE embedding_model = ?
+  AND (? = '' OR label = ?)
+  AND EXISTS (
+	SELECT 1 FROM fragments f
+	WHERE f.label = fragments.label AND f.document = fragments.document AND f.embedding_model = ?
+  )
+  AND (
+	chunk_index >= (
+	  SELECT count(*) FROM fragments f
+	  WHERE f.label = fragments.label AND f.document = fragments.document AND f.embedding_model = ?
+	)
+	OR NOT EXISTS (
+	  SELECT 1 FROM fragments f
+	  WHERE f.label = fragments.label AND f.name = fragments.name AND f.embedding_model = ?
+	)
+  )
+`
+
+	res, err := q.db.ExecContext(ctx, deleteStaleReembed,
+		arg.To,
+		arg.Label, arg.Label,
+		arg.From,
+		arg.From,
+		arg.From,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteEmbeddingModel removes all fragments embedded by the model, optionally only those with the label
+func (q *Queries) DeleteEmbeddingModel(ctx context.Context, embeddingModel string, label string) (int64, error) {
+
+	const deleteEmbeddingModel = `
+DELETE FROM fragments
+WHERE embedding_model = ? AND (? = '' OR label = ?)
+`
+
+	res, err := q.db.ExecContext(ctx, deleteEmbeddingModel,
+		embeddingModel,
+		label, label,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,271 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+type Session struct {
+	ID           int    `db:"id" json:"id"`
+	Name         string `db:"name" json:"name"`
+	Turns        int    `db:"turns" json:"turns"`
+	InputTokens  int    `db:"input_tokens" json:"input_tokens"`
+	OutputTokens int    `db:"output_tokens" json:"output_tokens"`
+	TotalTokens  int    `db:"total_tokens" json:"total_tokens"`
+	CreatedAt    int    `db:"created_at" json:"created_at"`
+	UpdatedAt    int    `db:"updated_at" json:"updated_at"`
+}
+
+type SessionTurn struct {
+	ID         int     `db:"id" json:"id"`
+	SessionID  int     `db:"session_id" json:"session_id"`
+	Question   string  `db:"question" json:"question"`
+	Query      string  `db:"query" json:"query"`
+	Answer     string  `db:"answer" json:"answer"`
+	Confidence float64 `db:"confidence" json:"confidence"`
+	// Sources are the ids of the fragments the answer cites
+	Sources []int `db:"sources" json:"sources"`
+	// FragmentIDs are the ids of the fragments that was retrieved for the turn and given to the llm
+	FragmentIDs  []int  `db:"fragment_ids" json:"fragment_ids"`
+	LLMModel     string `db:"llm_model" json:"llm_model"`
+	InputTokens  int    `db:"input_tokens" json:"input_tokens"`
+	OutputTokens int    `db:"output_tokens" json:"output_tokens"`
+	TotalTokens  int    `db:"total_tokens" json:"total_tokens"`
+	CreatedAt    int    `db:"created_at" json:"created_at"`
+}
+
+const sessionColumns = `
+SELECT s.id, s.name, count(t.id) AS turns,
+       coalesce(sum(t.input_tokens), 0) AS input_tokens,
+       coalesce(sum(t.output_tokens), 0) AS output_tokens,
+       coalesce(sum(t.total_tokens), 0) AS total_tokens,
+       s.created_at, s.updated_at
+FROM sessions s
+	LEFT JOIN session_turns t ON t.session_id = s.id
+`
+
+func scanSession(row scanner) (Session, error) {
+	var i Session
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Turns,
+		&i.InputTokens,
+		&i.OutputTokens,
+		&i.TotalTokens,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+// CreateSession returns the session with the name, creating it if it does not exist
+func (q *Queries) CreateSession(ctx context.Context, name string) (Session, error) {
+
+	const createSession = `
+INSERT INTO sessions (name)
+VALUES (?)
+ON CONFLICT (name) DO NOTHING
+`
+
+	_, err := q.db.ExecContext(ctx, createSession, name)
+	if err != nil {
+		return Session{}, fmt.Errorf("insert session: %w", err)
+	}
+	return q.GetSession(ctx, name)
+}
+
+// GetSession returns the session with the name, or sql.ErrNoRows if there is none
+func (q *Queries) GetSession(ctx context.Context, name string) (Session, error) {
+
+	const getSession = sessionColumns + `
+WHERE s.name = ?
+GROUP BY s.id
+`
+
+	return scanSession(q.db.QueryRowContext(ctx, getSession, name))
+}
+
+func (q *Queries) Sessions(ctx context.Context) ([]Session, error) {
+
+	const sessions = sessionColumns + `
+GROUP BY s.id
+ORDER BY s.updated_at DESC, s.name
+`
+
+	rows, err := q.db.QueryContext(ctx, sessions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Session
+	for rows.Next() {
+		i, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// DeleteSession deletes the session with the name and its turns, reporting whether there was such a session. Run
+// it in a transaction, so that the turns are not deleted without the session
+func (q *Queries) DeleteSession(ctx context.Context, name string) (bool, error) {
+
+	const deleteTurns = `
+DELETE FROM session_turns
+WHERE session_id IN (SELECT id FROM sessions WHERE name = ?)
+`
+	const deleteSession = `
+DELETE FROM sessions
+WHERE name = ?
+`
+
+	_, err := q.db.ExecContext(ctx, deleteTurns, name)
+	if err != nil {
+		return false, err
+	}
+	res, err := q.db.ExecContext(ctx, deleteSession, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ClearSession deletes the turns of a session, keeping the session itself
+func (q *Queries) ClearSession(ctx context.Context, sessionID int) error {
+
+	const clearSession = `
+DELETE FROM session_turns
+WHERE session_id = ?
+`
+
+	_, err := q.db.ExecContext(ctx, clearSession, sessionID)
+	return err
+}
+
+type AddSessionTurnParams struct {
+	SessionID    int
+	Question     string
+	Query        string
+	Answer       string
+	Confidence   float64
+	Sources      []int
+	FragmentIDs  []int
+	LLMModel     string
+	InputTokens  int
+	OutputTokens int
+	TotalTokens  int
+}
+
+// AddSessionTurn appends a turn to a session, and marks the session as updated
+func (q *Queries) AddSessionTurn(ctx context.Context, arg AddSessionTurnParams) error {
+
+	const addSessionTurn = `
+INSERT INTO session_turns (session_id, question, query, answer, confidence, sources, fragment_ids, llm_model, input_tokens, output_tokens, total_tokens)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+	const touchSession = `
+UPDATE sessions
+SET updated_at = strftime('%s', 'now')
+WHERE id = ?
+`
+
+	sources, err := json.Marshal(nonNil(arg.Sources))
+	if err != nil {
+		return err
+	}
+	fragmentIDs, err := json.Marshal(nonNil(arg.FragmentIDs))
+	if err != nil {
+		return err
+	}
+
+	_, err = q.db.ExecContext(ctx, addSessionTurn,
+		arg.SessionID,
+		arg.Question,
+		arg.Query,
+		arg.Answer,
+		arg.Confidence,
+		string(sources),
+		string(fragmentIDs),
+		arg.LLMModel,
+		arg.InputTokens,
+		arg.OutputTokens,
+		arg.TotalTokens,
+	)
+	if err != nil {
+		return fmt.Errorf("insert session turn: %w", err)
+	}
+	_, err = q.db.ExecContext(ctx, touchSession, arg.SessionID)
+	return err
+}
+
+// SessionTurns returns the turns of a session, oldest first
+func (q *Queries) SessionTurns(ctx context.Context, sessionID int) ([]SessionTurn, error) {
+
+	const sessionTurns = `
+SELECT id, session_id, question, query, answer, confidence, sources, fragment_ids, llm_model, input_tokens, output_tokens, total_tokens, created_at
+FROM session_turns
+WHERE session_id = ?
+ORDER BY id
+`
+
+	rows, err := q.db.QueryContext(ctx, sessionTurns, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SessionTurn
+	for rows.Next() {
+		var i SessionTurn
+		var sources, fragmentIDs string
+		if err := rows.Scan(
+			&i.ID,
+			&i.SessionID,
+			&i.Question,
+			&i.Query,
+			&i.Answer,
+			&i.Confidence,
+			&sources,
+			&fragmentIDs,
+			&i.LLMModel,
+			&i.InputTokens,
+			&i.OutputTokens,
+			&i.TotalTokens,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(sources), &i.Sources); err != nil {
+			return nil, fmt.Errorf("decoding sources of turn %d: %w", i.ID, err)
+		}
+		if err := json.Unmarshal([]byte(fragmentIDs), &i.FragmentIDs); err != nil {
+			return nil, fmt.Errorf("decoding fragment ids of turn %d: %w", i.ID, err)
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// nonNil makes nil slices marshal as empty json arrays rather than null
+func nonNil(ids []int) []int {
+	if ids == nil {
+		return []int{}
+	}
+	return ids
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testDao opens an empty, migrated database
+func testDao(t *testing.T) *Queries {
+	t.Helper()
+	conn, err := Open(context.Background(), filepath.Join(t.TempDir(), "blot.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return New(conn)
+}
+
+func TestSessions(t *testing.T) {
+	ctx := context.Background()
+	dao := testDao(t)
+
+	session, err := dao.CreateSession(ctx, "onboarding")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	again, err := dao.CreateSession(ctx, "onboarding")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if again.ID != session.ID {
+		t.Errorf("Expected creating an existing session to return it, got %d and %d", session.ID, again.ID)
+	}
+
+	turns := []AddSessionTurnParams{
+		{SessionID: session.ID, Question: "how many vacation days?", Query: "how many vacation days?", Answer: "25",
+			Confidence: 0.9, Sources: []int{2}, FragmentIDs: []int{2, 3}, LLMModel: "Mock/llm", InputTokens: 10, OutputTokens: 2, TotalTokens: 12},
+		{SessionID: session.ID, Question: "and sick days?", Query: "how many sick days?", Answer: "unknown",
+			LLMModel: "Mock/llm", InputTokens: 20, OutputTokens: 3, TotalTokens: 23},
+	}
+	for _, turn := range turns {
+		err = dao.AddSessionTurn(ctx, turn)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	session, err = dao.GetSession(ctx, "onboarding")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if session.Turns != 2 || session.InputTokens != 30 || session.OutputTokens != 5 || session.TotalTokens != 35 {
+		t.Errorf("Expected the turns and tokens of the session to be summed, got %+v", session)
+	}
+
+	got, err := dao.SessionTurns(ctx, session.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 turns, got %d", len(got))
+	}
+	if got[0].Question != "how many vacation days?" || !reflect.DeepEqual(got[0].Sources, []int{2}) || !reflect.DeepEqual(got[0].FragmentIDs, []int{2, 3}) {
+		t.Errorf("Expected the first turn first, with its sources and fragments, got %+v", got[0])
+	}
+	if got[1].Sources == nil || len(got[1].Sources) != 0 {
+		t.Errorf("Expected a turn without sources to have empty sources, got %v", got[1].Sources)
+	}
+
+	_, err = dao.CreateSession(ctx, "empty")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sessions, err := dao.Sessions(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Errorf("Expected 2 sessions, got %v", sessions)
+	}
+
+	err = dao.ClearSession(ctx, session.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	session, err = dao.GetSession(ctx, "onboarding")
+	if err != nil {
+		t.Fatalf("Expected a cleared session to be kept, got %v", err)
+	}
+	if session.Turns != 0 {
+		t.Errorf("Expected a cleared session to have no turns, got %d", session.Turns)
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	ctx := context.Background()
+	dao := testDao(t)
+
+	session, err := dao.CreateSession(ctx, "onboarding")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = dao.AddSessionTurn(ctx, AddSessionTurnParams{SessionID: session.ID, Question: "q", Answer: "a"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	deleted, err := dao.DeleteSession(ctx, "onboarding")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !deleted {
+		t.Errorf("Expected the session to be deleted")
+	}
+	_, err = dao.GetSession(ctx, "onboarding")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected the session to be gone, got %v", err)
+	}
+	turns, err := dao.SessionTurns(ctx, session.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(turns) != 0 {
+		t.Errorf("Expected the turns to be deleted with the session, got %v", turns)
+	}
+
+	deleted, err = dao.DeleteSession(ctx, "onboarding")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if deleted {
+		t.Errorf("Expected no session to be deleted the second time")
+	}
+}
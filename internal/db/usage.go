@@ -0,0 +1,213 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type AddUsageParams struct {
+	Command string
+	// Kind is the kind of request, embed, gen or rerank
+	Kind         string
+	Model        string
+	InputTokens  int
+	OutputTokens int
+	TotalTokens  int
+	// Cost is in USD, at the price of the model when the request was made
+	Cost      float64
+	LatencyMs int
+	// Error is the error of a failed request, empty if it succeeded
+	Error string
+}
+
+// AddUsage records the tokens used by a request in the usage ledger
+func (q *Queries) AddUsage(ctx context.Context, arg AddUsageParams) error {
+
+	const addUsage = `
+INSERT INTO usage_ledger (command, kind, model, input_tokens, output_tokens, total_tokens, cost, latency_ms, error)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, nullif(?, ''))
+`
+
+	_, err := q.db.ExecContext(ctx, addUsage,
+		arg.Command,
+		arg.Kind,
+		arg.Model,
+		arg.InputTokens,
+		arg.OutputTokens,
+		arg.TotalTokens,
+		arg.Cost,
+		arg.LatencyMs,
+		arg.Error,
+	)
+	return err
+}
+
+// Usage is the usage of a group of requests in the ledger. The columns that are not grouped by are empty
+type Usage struct {
+	Day          string  `db:"day" json:"day,omitempty"`
+	Model        string  `db:"model" json:"model,omitempty"`
+	Command      string  `db:"command" json:"command,omitempty"`
+	Kind         string  `db:"kind" json:"kind,omitempty"`
+	Requests     int     `db:"requests" json:"requests"`
+	Errors       int     `db:"errors" json:"errors"`
+	InputTokens  int     `db:"input_tokens" json:"input_tokens"`
+	OutputTokens int     `db:"output_tokens" json:"output_tokens"`
+	TotalTokens  int     `db:"total_tokens" json:"total_tokens"`
+	Cost         float64 `db:"cost" json:"cost"`
+	// LatencyMs is the average latency of the requests
+	LatencyMs int `db:"latency_ms" json:"latency_ms"`
+}
+
+// usageGroups are the columns usage can be grouped by, days are in local time
+var usageGroups = map[string]string{
+	"day":     `date(created_at, 'unixepoch', 'localtime')`,
+	"model":   `model`,
+	"command": `command`,
+	"kind":    `kind`,
+}
+
+type UsageReportParams struct {
+	// Since is the unix time of the first request to include, 0 includes all
+	Since int
+	// By are the columns to group by, day, model, command or kind
+	By []string
+}
+
+// UsageReport sums the usage in the ledger by the grouped columns, in the order given
+func (q *Queries) UsageReport(ctx context.Context, arg UsageReportParams) ([]Usage, error) {
+
+	columns := map[string]string{"day": `''`, "model": `''`, "command": `''`, "kind": `''`}
+	var groups []string
+	for _, by := range arg.By {
+		expr, ok := usageGroups[by]
+		if !ok {
+			return nil, fmt.Errorf("unknown usage group '%s', expected day, model, command or kind", by)
+		}
+		columns[by] = expr
+		groups = append(groups, expr)
+	}
+	groupBy := ""
+	if len(groups) > 0 {
+		groupBy = "GROUP BY " + strings.Join(groups, ", ") + "\nORDER BY " + strings.Join(groups, ", ")
+	}
+
+	usageReport := fmt.Sprintf(`
+SELECT %s, %s, %s, %s,
+       count(*),
+       count(error),
+       coalesce(sum(input_tokens), 0),
+       coalesce(sum(output_tokens), 0),
+       coalesce(sum(total_tokens), 0),
+       coalesce(sum(cost), 0),
+       coalesce(cast(avg(latency_ms) AS INTEGER), 0)
+FROM usage_ledger
+WHERE created_at >= ?
+%s
+`, columns["day"], columns["model"], columns["command"], columns["kind"], groupBy)
+
+	rows, err := q.db.QueryContext(ctx, usageReport, arg.Since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Usage
+	for rows.Next() {
+		var i Usage
+		if err := rows.Scan(
+			&i.Day,
+			&i.Model,
+			&i.Command,
+			&i.Kind,
+			&i.Requests,
+			&i.Errors,
+			&i.InputTokens,
+			&i.OutputTokens,
+			&i.TotalTokens,
+			&i.Cost,
+			&i.LatencyMs,
+		); err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 && i.Requests == 0 {
+			continue
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+type ModelPrice struct {
+	Model string `db:"model" json:"model"`
+	// InputPrice and OutputPrice are in USD per million tokens
+	InputPrice  float64 `db:"input_price" json:"input_price"`
+	OutputPrice float64 `db:"output_price" json:"output_price"`
+	UpdatedAt   int     `db:"updated_at" json:"updated_at"`
+}
+
+func (q *Queries) ModelPrices(ctx context.Context) ([]ModelPrice, error) {
+
+	const modelPrices = `
+SELECT model, input_price, output_price, updated_at
+FROM model_prices
+ORDER BY model
+`
+
+	rows, err := q.db.QueryContext(ctx, modelPrices)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ModelPrice
+	for rows.Next() {
+		var i ModelPrice
+		if err := rows.Scan(&i.Model, &i.InputPrice, &i.OutputPrice, &i.UpdatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// SetModelPrice sets the price of a model, in USD per million tokens
+func (q *Queries) SetModelPrice(ctx context.Context, model string, inputPrice float64, outputPrice float64) error {
+
+	const setModelPrice = `
+INSERT INTO model_prices (model, input_price, output_price)
+VALUES (?, ?, ?)
+ON CONFLICT (model) DO UPDATE SET input_price  = excluded.input_price,
+                                  output_price = excluded.output_price,
+                                  updated_at   = strftime('%s', 'now')
+`
+
+	_, err := q.db.ExecContext(ctx, setModelPrice, model, inputPrice, outputPrice)
+	return err
+}
+
+// DeleteModelPrice deletes the price of a model, reporting whether it had one
+func (q *Queries) DeleteModelPrice(ctx context.Context, model string) (bool, error) {
+
+	const deleteModelPrice = `
+DELETE FROM model_prices
+WHERE model = ?
+`
+
+	res, err := q.db.ExecContext(ctx, deleteModelPrice, model)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,160 @@
+package vec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Encoding identifies how a vector is stored. Encoded vectors start with a header byte holding the encoding,
+// so that vectors of different encodings can be stored side by side and compared with each other
+type Encoding byte
+
+const (
+	// Float64 stores every dimension as 8 bytes, losslessly
+	Float64 Encoding = 1
+	// Float32 stores every dimension as 4 bytes, which is the precision embedding apis return
+	Float32 Encoding = 2
+	// Int8 stores a float32 scale followed by every dimension as 1 byte, scaled such that the dimension with the
+	// largest magnitude is ±127
+	Int8 Encoding = 3
+	// Binary stores the number of dimensions as an uint32 followed by the sign of every dimension as 1 bit.
+	// Dimensions are decoded as ±1, which keeps the angle between vectors approximately
+	Binary Encoding = 4
+)
+
+const DefaultEncoding = Float32
+
+func ParseEncoding(s string) (Encoding, error) {
+	switch s {
+	case "":
+		return DefaultEncoding, nil
+	case "float64":
+		return Float64, nil
+	case "float32":
+		return Float32, nil
+	case "int8":
+		return Int8, nil
+	case "binary":
+		return Binary, nil
+	default:
+		return 0, fmt.Errorf("unknown vector encoding '%s', expected float64, float32, int8 or binary", s)
+	}
+}
+
+func (e Encoding) String() string {
+	switch e {
+	case Float64:
+		return "float64"
+	case Float32:
+		return "float32"
+	case Int8:
+		return "int8"
+	case Binary:
+		return "binary"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(e))
+	}
+}
+
+// Encode encodes v with a header byte identifying the encoding. Unknown encodings, including the zero value,
+// are encoded as Float64 so that no precision is lost
+func Encode(v []float64, enc Encoding) []byte {
+	switch enc {
+	case Float32:
+		data := make([]byte, 1+4*len(v))
+		for i, f := range v {
+			binary.LittleEndian.PutUint32(data[1+4*i:], math.Float32bits(float32(f)))
+		}
+		data[0] = byte(Float32)
+		return data
+
+	case Int8:
+		var maxAbs float64
+		for _, f := range v {
+			maxAbs = max(maxAbs, math.Abs(f))
+		}
+		scale := float32(maxAbs / 127)
+
+		data := make([]byte, 1+4+len(v))
+		data[0] = byte(Int8)
+		binary.LittleEndian.PutUint32(data[1:], math.Float32bits(scale))
+		for i, f := range v {
+			var q float64
+			if scale > 0 {
+				q = math.Round(f / float64(scale))
+			}
+			data[5+i] = byte(int8(max(-127, min(127, q))))
+		}
+		return data
+
+	case Binary:
+		data := make([]byte, 1+4+(len(v)+7)/8)
+		data[0] = byte(Binary)
+		binary.LittleEndian.PutUint32(data[1:], uint32(len(v)))
+		for i, f := range v {
+			if f > 0 {
+				data[5+i/8] |= 1 << (i % 8)
+			}
+		}
+		return data
+
+	default:
+		return append([]byte{byte(Float64)}, EncodeVector(v)...)
+	}
+}
+
+// Decode decodes a vector encoded by Encode, whatever its encoding
+func Decode(data []byte) ([]float64, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("invalid vector: missing encoding header")
+	}
+	enc, payload := Encoding(data[0]), data[1:]
+
+	switch enc {
+	case Float64:
+		return DecodeVector(payload)
+
+	case Float32:
+		if len(payload)%4 != 0 {
+			return nil, fmt.Errorf("invalid float32 vector: %d bytes is not divisible by 4", len(payload))
+		}
+		v := make([]float64, len(payload)/4)
+		for i := range v {
+			v[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(payload[4*i:])))
+		}
+		return v, nil
+
+	case Int8:
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("invalid int8 vector: missing scale")
+		}
+		scale := float64(math.Float32frombits(binary.LittleEndian.Uint32(payload)))
+		v := make([]float64, len(payload)-4)
+		for i := range v {
+			v[i] = float64(int8(payload[4+i])) * scale
+		}
+		return v, nil
+
+	case Binary:
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("invalid binary vector: missing dimensions")
+		}
+		dims := int(binary.LittleEndian.Uint32(payload))
+		bits := payload[4:]
+		if len(bits) != (dims+7)/8 {
+			return nil, fmt.Errorf("invalid binary vector: %d bytes can not hold %d dimensions", len(bits), dims)
+		}
+		v := make([]float64, dims)
+		for i := range v {
+			v[i] = -1
+			if bits[i/8]&(1<<(i%8)) != 0 {
+				v[i] = 1
+			}
+		}
+		return v, nil
+
+	default:
+		return nil, fmt.Errorf("invalid vector: unknown encoding %d", byte(enc))
+	}
+}
@@ -0,0 +1,118 @@
+package vec
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	input := []float64{0.5, -0.25, 0.125, 0, -1}
+
+	tests := []struct {
+		name      string
+		encoding  Encoding
+		length    int
+		want      []float64
+		tolerance float64
+	}{
+		{
+			name:     "Float64 is lossless",
+			encoding: Float64,
+			length:   1 + 5*8,
+			want:     input,
+		},
+		{
+			name:     "Float32 keeps float32 values",
+			encoding: Float32,
+			length:   1 + 5*4,
+			want:     input,
+		},
+		{
+			name:      "Int8 is scaled to the largest magnitude",
+			encoding:  Int8,
+			length:    1 + 4 + 5,
+			want:      input,
+			tolerance: 1.0 / 127,
+		},
+		{
+			name:     "Binary keeps the signs",
+			encoding: Binary,
+			length:   1 + 4 + 1,
+			want:     []float64{1, -1, 1, -1, -1},
+		},
+		{
+			name:     "Unknown encoding is Float64",
+			encoding: 0,
+			length:   1 + 5*8,
+			want:     input,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := Encode(input, tt.encoding)
+			if len(encoded) != tt.length {
+				t.Errorf("Expected length %d, got %d", tt.length, len(encoded))
+			}
+
+			decoded, err := Decode(encoded)
+			if err != nil {
+				t.Fatalf("Unexpected error during decoding: %v", err)
+			}
+			if len(decoded) != len(tt.want) {
+				t.Fatalf("Expected %d dimensions, got %d", len(tt.want), len(decoded))
+			}
+			for i := range tt.want {
+				if math.Abs(decoded[i]-tt.want[i]) > tt.tolerance {
+					t.Errorf("At index %d: Expected %v, got %v", i, tt.want[i], decoded[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{
+			name:  "Missing header",
+			input: []byte{},
+		},
+		{
+			name:  "Unknown encoding",
+			input: []byte{42, 0, 0, 0, 0},
+		},
+		{
+			name:  "Truncated float32",
+			input: []byte{byte(Float32), 0, 0, 0},
+		},
+		{
+			name:  "Binary with too few bits",
+			input: []byte{byte(Binary), 9, 0, 0, 0, 0xff},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.input)
+			if err == nil {
+				t.Errorf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestEncodeEmpty(t *testing.T) {
+	for _, enc := range []Encoding{Float64, Float32, Int8, Binary} {
+		decoded, err := Decode(Encode([]float64{}, enc))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", enc, err)
+		}
+		if !reflect.DeepEqual(decoded, []float64{}) {
+			t.Errorf("%s: expected empty vector, got %v", enc, decoded)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package vec
+
+import (
+	"math"
+	"math/rand/v2"
+	"sort"
+)
+
+// KMeans clusters vectors into k clusters by spherical k-means, ie. vectors are normalized and compared by
+// cosine similarity. The returned centroids are normalized. Initial centroids are picked with a fixed seed,
+// so clustering the same vectors twice results in the same centroids
+func KMeans(vectors [][]float64, k int, iterations int) [][]float64 {
+	if len(vectors) == 0 || k <= 0 {
+		return nil
+	}
+	k = min(k, len(vectors))
+
+	points := make([][]float64, len(vectors))
+	for i, v := range vectors {
+		points[i] = Normalize(v)
+	}
+
+	rnd := rand.New(rand.NewPCG(1, 2))
+	centroids := make([][]float64, k)
+	for i, j := range rnd.Perm(len(points))[:k] {
+		centroids[i] = append([]float64{}, points[j]...)
+	}
+
+	assignment := make([]int, len(points))
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	for iter := 0; iter < iterations; iter++ {
+		var changed bool
+		for i, p := range points {
+			c := Nearest(centroids, p, 1)[0]
+			changed = changed || c != assignment[i]
+			assignment[i] = c
+		}
+		if !changed {
+			break
+		}
+
+		sums := make([][]float64, k)
+		for i := range sums {
+			sums[i] = make([]float64, len(points[0]))
+		}
+		counts := make([]int, k)
+		for i, p := range points {
+			c := assignment[i]
+			counts[c]++
+			for d, x := range p {
+				sums[c][d] += x
+			}
+		}
+		for c := range centroids {
+			// an empty cluster keeps its centroid
+			if counts[c] == 0 {
+				continue
+			}
+			centroids[c] = Normalize(sums[c])
+		}
+	}
+
+	return centroids
+}
+
+// Nearest returns the indexes of the n centroids with the highest cosine similarity to v, closest first.
+// Centroids are expected to be normalized
+func Nearest(centroids [][]float64, v []float64, n int) []int {
+	type scored struct {
+		index int
+		score float64
+	}
+	scores := make([]scored, 0, len(centroids))
+	for i, c := range centroids {
+		if len(c) != len(v) {
+			continue
+		}
+		var dot float64
+		for d := range c {
+			dot += c[d] * v[d]
+		}
+		scores = append(scores, scored{index: i, score: dot})
+	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].score > scores[j].score
+	})
+
+	var res []int
+	for _, s := range scores[:min(n, len(scores))] {
+		res = append(res, s.index)
+	}
+	return res
+}
+
+// Normalize returns a copy of v scaled to unit length, a zero vector is returned as is
+func Normalize(v []float64) []float64 {
+	var norm float64
+	for _, x := range v {
+		norm += x * x
+	}
+	res := make([]float64, len(v))
+	if norm == 0 {
+		return res
+	}
+	norm = math.Sqrt(norm)
+	for i, x := range v {
+		res[i] = x / norm
+	}
+	return res
+}
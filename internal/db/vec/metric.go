@@ -0,0 +1,101 @@
+package vec
+
+import (
+	"fmt"
+	"math"
+)
+
+// Metric is how the distance between vectors is measured. Every metric is registered as a sql function, where a
+// smaller value means closer, so that similarity metrics are negated
+type Metric string
+
+const (
+	// Cosine is the negative cosine similarity, which ignores the length of the vectors
+	Cosine Metric = "cosine"
+	// Dot is the negative dot product, for models designed for dot product similarity
+	Dot Metric = "dot"
+	// Euclidean is the L2 distance
+	Euclidean Metric = "euclidean"
+	// Manhattan is the L1 distance
+	Manhattan Metric = "manhattan"
+)
+
+const DefaultMetric = Cosine
+
+var distances = map[Metric]func(left, right []float64) float64{
+	Cosine:    cosineDistance,
+	Dot:       dotDistance,
+	Euclidean: euclideanDistance,
+	Manhattan: manhattanDistance,
+}
+
+func ParseMetric(s string) (Metric, error) {
+	if s == "" {
+		return DefaultMetric, nil
+	}
+	if _, ok := distances[Metric(s)]; !ok {
+		return "", fmt.Errorf("unknown distance metric '%s', expected cosine, dot, euclidean or manhattan", s)
+	}
+	return Metric(s), nil
+}
+
+// Function is the name of the sql function computing the distance, eg. vec_dist_cosine(a, b)
+func (m Metric) Function() string {
+	return "vec_dist_" + string(m)
+}
+
+// Score turns a distance into a score where higher is better. Cosine and dot scores are the similarities, ie. the
+// cosine similarity in [-1, 1] and the dot product, while euclidean and manhattan distances are scored as
+// 1 / (1 + distance) in (0, 1]
+func (m Metric) Score(distance float64) float64 {
+	switch m {
+	case Euclidean, Manhattan:
+		return 1 / (1 + distance)
+	default:
+		return -distance
+	}
+}
+
+func cosineDistance(left, right []float64) float64 {
+	var dotProduct float64
+	var normA float64
+	var normB float64
+
+	for i := 0; i < min(len(left), len(right)); i++ {
+		dotProduct += left[i] * right[i]
+		normA += left[i] * left[i]
+		normB += right[i] * right[i]
+	}
+
+	// Prevent division by zero
+	if normA == 0 || normB == 0 {
+		return 0.0
+	}
+
+	return -(dotProduct / (math.Sqrt(normA) * math.Sqrt(normB)))
+}
+
+func dotDistance(left, right []float64) float64 {
+	var dotProduct float64
+	for i := 0; i < min(len(left), len(right)); i++ {
+		dotProduct += left[i] * right[i]
+	}
+	return -dotProduct
+}
+
+func euclideanDistance(left, right []float64) float64 {
+	var sum float64
+	for i := 0; i < min(len(left), len(right)); i++ {
+		d := left[i] - right[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+func manhattanDistance(left, right []float64) float64 {
+	var sum float64
+	for i := 0; i < min(len(left), len(right)); i++ {
+		sum += math.Abs(left[i] - right[i])
+	}
+	return sum
+}
@@ -0,0 +1,50 @@
+package vec
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistances(t *testing.T) {
+	left := []float64{1, 2, 2}
+	right := []float64{2, 0, 0}
+
+	tests := []struct {
+		metric Metric
+		want   float64
+	}{
+		{metric: Cosine, want: -2.0 / 6},
+		{metric: Dot, want: -2},
+		{metric: Euclidean, want: 3},
+		{metric: Manhattan, want: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.metric), func(t *testing.T) {
+			got := distances[tt.metric](left, right)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseMetric(t *testing.T) {
+	m, err := ParseMetric("")
+	if err != nil || m != DefaultMetric {
+		t.Errorf("Expected default metric, got %v, %v", m, err)
+	}
+	_, err = ParseMetric("l2")
+	if err == nil {
+		t.Errorf("Expected error for unknown metric")
+	}
+}
+
+func TestScore(t *testing.T) {
+	if got := Cosine.Score(-0.5); got != 0.5 {
+		t.Errorf("Expected cosine score 0.5, got %v", got)
+	}
+	if got := Euclidean.Score(1); got != 0.5 {
+		t.Errorf("Expected euclidean score 0.5, got %v", got)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"database/sql/driver"
 	"fmt"
 	"log/slog"
-	"math"
 	"modernc.org/sqlite"
 	"sync/atomic"
 	"time"
@@ -30,8 +29,16 @@ func Statistics() {
 }
 
 func init() {
+	// vec_dist is kept as cosine distance, which it was before metrics could be chosen
+	registerDistance("vec_dist", cosineDistance)
+	for metric, dist := range distances {
+		registerDistance(metric.Function(), dist)
+	}
+}
 
-	sqlite.MustRegisterDeterministicScalarFunction("vec_dist", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+// registerDistance registers a sql function taking two encoded vectors, returning the distance between them
+func registerDistance(name string, dist func(left, right []float64) float64) {
+	sqlite.MustRegisterDeterministicScalarFunction(name, 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
 		start := time.Now()
 		defer func() {
 			vec_dist_tot.Add(int64(time.Since(start)))
@@ -53,12 +60,12 @@ func init() {
 
 		unmarshalStart := time.Now()
 
-		left, err := DecodeVector(leftbin)
+		left, err := Decode(leftbin)
 		if err != nil {
 			return nil, err
 		}
 
-		right, err := DecodeVector(rightbin)
+		right, err := Decode(rightbin)
 		if err != nil {
 			return nil, err
 		}
@@ -71,26 +78,10 @@ func init() {
 		}
 
 		comparisonStart := time.Now()
-		var dotProduct float64
-		var normA float64
-		var normB float64
-
-		for i := 0; i < min(len(left), len(right)); i++ {
-			dotProduct += left[i] * right[i]
-			normA += left[i] * left[i]
-			normB += right[i] * right[i]
-		}
+		result := dist(left, right)
 		comparisonTime := time.Since(comparisonStart)
 		vec_dist_comp.Add(int64(comparisonTime))
 
-		// Prevent division by zero
-		if normA == 0 || normB == 0 {
-			return 0.0, nil
-		}
-
-		result := -(dotProduct / (math.Sqrt(normA) * math.Sqrt(normB)))
-
 		return result, nil
 	})
-
 }
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/blot/internal/ai"
+	"github.com/modfin/blot/internal/db"
+	"github.com/modfin/blot/internal/db/vec"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxRequestBytes is the largest request body accepted, larger requests are refused with 413
+	maxRequestBytes = 10 << 20
+	// readHeaderTimeout bounds how long a client may take to send the request headers
+	readHeaderTimeout = 10 * time.Second
+)
+
+// Server exposes the knowledge base over a JSON http api. All requests share the database connection and
+// the proxy of the configuration, while limits, mode and system prompt may be set per request
+type Server struct {
+	cfg *ai.Conf
+}
+
+func New(cfg *ai.Conf) *Server {
+	return &Server{cfg: cfg}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /add", s.add)
+	mux.HandleFunc("POST /search", s.search)
+	mux.HandleFunc("POST /prompt", s.prompt)
+	mux.HandleFunc("POST /fill", s.fill)
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	return mux
+}
+
+// ListenAndServe serves until ctx is done, after which in flight requests are given shutdownTimeout to finish
+func (s *Server) ListenAndServe(ctx context.Context, addr string, shutdownTimeout time.Duration) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: readHeaderTimeout,
+		BaseContext: func(_ net.Listener) context.Context {
+			return context.WithoutCancel(ctx)
+		},
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		slog.Default().Info("serving", "addr", addr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Default().Info("shutting down", "timeout", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		return fmt.Errorf("failed to shut down gracefully: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+type retrieval struct {
+	Limits       []string `json:"limits,omitempty"`
+	Mode         string   `json:"mode,omitempty"`
+	Metric       string   `json:"metric,omitempty"`
+	MinScore     *float64 `json:"min_score,omitempty"`
+	RerankModel  string   `json:"rerank_model,omitempty"`
+	MMRLambda    *float64 `json:"mmr_lambda,omitempty"`
+	SystemPrompt string   `json:"system_prompt,omitempty"`
+}
+
+// conf scopes the configuration to the request
+func (s *Server) conf(r *http.Request, req retrieval) (*ai.Conf, error) {
+	cfg := s.cfg.WithContext(r.Context())
+	if len(req.Limits) > 0 {
+		cfg = cfg.WithLimits(ai.ParseLimits(req.Limits))
+	}
+	if req.Mode != "" {
+		mode, err := ai.ParseMode(req.Mode)
+		if err != nil {
+			return nil, err
+		}
+		cfg = cfg.WithMode(mode)
+	}
+	if req.Metric != "" {
+		metric, err := vec.ParseMetric(req.Metric)
+		if err != nil {
+			return nil, err
+		}
+		cfg = cfg.WithMetric(metric)
+	}
+	if req.MinScore != nil {
+		cfg = cfg.WithMinScore(*req.MinScore)
+	}
+	if req.RerankModel != "" {
+		cfg = cfg.WithRerankModel(ai.ParseRerankModel(req.RerankModel))
+	}
+	if req.MMRLambda != nil {
+		if *req.MMRLambda < 0 || *req.MMRLambda > 1 {
+			return nil, fmt.Errorf("mmr lambda must be in [0, 1], got %v", *req.MMRLambda)
+		}
+		cfg = cfg.WithMMRLambda(*req.MMRLambda)
+	}
+	if req.SystemPrompt != "" {
+		cfg = cfg.WithSystemPrompt(req.SystemPrompt)
+	}
+	err := ai.CheckMinScore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+type fragment struct {
+	ID         int     `json:"id"`
+	Label      string  `json:"label"`
+	Name       string  `json:"name"`
+	Document   string  `json:"document"`
+	ChunkIndex int     `json:"chunk_index"`
+	Score      float64 `json:"score,omitempty"`
+	Content    string  `json:"content,omitempty"`
+}
+
+func toFragments(frags []db.Fragment, withContent bool) []fragment {
+	res := make([]fragment, 0, len(frags))
+	for _, f := range frags {
+		frag := fragment{
+			ID:         f.ID,
+			Label:      f.Label,
+			Name:       f.Name,
+			Document:   f.Document,
+			ChunkIndex: f.ChunkIndex,
+			Score:      f.Score,
+		}
+		if withContent {
+			frag.Content = f.Content
+		}
+		res = append(res, frag)
+	}
+	return res
+}
+
+type answer struct {
+	Answer          string          `json:"answer"`
+	ConfidenceScore float32         `json:"confidence_score"`
+	Sources         []fragment      `json:"sources"`
+	Metadata        models.Metadata `json:"metadata"`
+}
+
+func toAnswer(ans ai.Answer) answer {
+	return answer{
+		Answer:          ans.Answer,
+		ConfidenceScore: ans.ConfidenceScore,
+		Sources:         toFragments(ans.Citations, false),
+		Metadata:        ans.Metadata,
+	}
+}
+
+type addRequest struct {
+	Label   string `json:"label"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+type addResponse struct {
+	Fragments []fragment `json:"fragments"`
+}
+
+func (s *Server) add(w http.ResponseWriter, r *http.Request) {
+	var req addRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+	if req.Label == "" {
+		req.Label = "default"
+	}
+
+	cfg := s.cfg.WithContext(r.Context())
+	frags, err := ai.AddDocument(cfg, req.Label, req.Name, req.Content)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = ai.EnsureIndex(cfg)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, addResponse{Fragments: toFragments(frags, false)})
+}
+
+type searchRequest struct {
+	retrieval
+	Question string `json:"question"`
+	Emit     bool   `json:"emit,omitempty"`
+}
+
+type searchResponse struct {
+	Fragments []fragment `json:"fragments"`
+}
+
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	var req searchRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	cfg, err := s.conf(r, req.retrieval)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	frags, err := ai.Search(cfg, req.Question)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, searchResponse{Fragments: toFragments(frags, req.Emit)})
+}
+
+type promptRequest struct {
+	retrieval
+	Question string `json:"question"`
+}
+
+func (s *Server) prompt(w http.ResponseWriter, r *http.Request) {
+	var req promptRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	cfg, err := s.conf(r, req.retrieval)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ans, err := ai.Query(cfg, req.Question)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAnswer(ans))
+}
+
+type fillRequest struct {
+	retrieval
+	Headers []string   `json:"headers,omitempty"`
+	Rows    [][]string `json:"rows"`
+}
+
+type fillResponse struct {
+	Rows []answer `json:"rows"`
+}
+
+func (s *Server) fill(w http.ResponseWriter, r *http.Request) {
+	var req fillRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	cfg, err := s.conf(r, req.retrieval)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	res := fillResponse{Rows: make([]answer, 0, len(req.Rows))}
+	for i, record := range req.Rows {
+		ans, err := ai.FillRow(cfg, req.Headers, record)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to fill row %d: %w", i, err))
+			return
+		}
+		res.Rows = append(res.Rows, toAnswer(ans))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(v)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request is larger than %d bytes", tooLarge.Limit))
+		return false
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to decode request: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Default().Warn("failed to write response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	slog.Default().Warn("request failed", "status", status, "err", err)
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
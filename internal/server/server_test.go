@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/modfin/blot/internal/ai"
+	"github.com/urfave/cli/v3"
+)
+
+// testServer serves an empty knowledge base using the mock provider
+func testServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	var cfg *ai.Conf
+	cmd := &cli.Command{
+		Name: "serve",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "db", Value: filepath.Join(t.TempDir(), "blot.db")},
+			&cli.StringFlag{Name: "embed-model", Value: ai.MockProvider + "/embed"},
+			&cli.StringFlag{Name: "llm-model", Value: ai.MockProvider + "/llm"},
+			&cli.StringSliceFlag{Name: "limit", Value: []string{"3"}},
+			&cli.StringFlag{Name: "chunk-strategy", Value: "none"},
+		},
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			var err error
+			cfg, err = ai.LoadConf(ctx, cmd)
+			return err
+		},
+	}
+	err := cmd.Run(context.Background(), []string{"serve"})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	srv := httptest.NewServer(New(cfg).Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// post sends the body, marshalled unless it is a string, and decodes the response into res, if given
+func post(t *testing.T, srv *httptest.Server, path string, body any, res any) int {
+	t.Helper()
+
+	data, ok := body.(string)
+	if !ok {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = string(b)
+	}
+
+	resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to post %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if res != nil {
+		err = json.NewDecoder(resp.Body).Decode(res)
+		if err != nil {
+			t.Fatalf("Failed to decode response of %s: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func addDocuments(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	for _, doc := range []addRequest{
+		{Label: "policies", Name: "remote.md", Content: "Remote work is allowed two days a week for all employees."},
+		{Label: "policies", Name: "vacation.md", Content: "Vacation is twenty five days per year, planned with your manager."},
+	} {
+		var res addResponse
+		status := post(t, srv, "/add", doc, &res)
+		if status != http.StatusOK || len(res.Fragments) != 1 {
+			t.Fatalf("Expected %s to be added as one fragment, got %d %v", doc.Name, status, res)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	srv := testServer(t)
+
+	resp, err := http.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	srv := testServer(t)
+
+	var res addResponse
+	status := post(t, srv, "/add", addRequest{Name: "office.md", Content: "The office opens at eight."}, &res)
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if len(res.Fragments) != 1 || res.Fragments[0].Label != "default" || res.Fragments[0].Name != "office.md" {
+		t.Errorf("Expected office.md to be added to the default label, got %v", res.Fragments)
+	}
+
+	// adding the same content again embeds nothing
+	status = post(t, srv, "/add", addRequest{Name: "office.md", Content: "The office opens at eight."}, &res)
+	if status != http.StatusOK || len(res.Fragments) != 0 {
+		t.Errorf("Expected an unchanged document not to be added again, got %d %v", status, res.Fragments)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	srv := testServer(t)
+	addDocuments(t, srv)
+
+	var res searchResponse
+	status := post(t, srv, "/search", searchRequest{Question: "how many vacation days per year?", Emit: true}, &res)
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if len(res.Fragments) == 0 || res.Fragments[0].Name != "vacation.md" || res.Fragments[0].Content == "" {
+		t.Errorf("Expected vacation.md first, with its content, got %v", res.Fragments)
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	srv := testServer(t)
+	addDocuments(t, srv)
+
+	var res answer
+	status := post(t, srv, "/prompt", promptRequest{Question: "is remote work allowed?"}, &res)
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if len(res.Sources) != 1 || res.Sources[0].Name != "remote.md" {
+		t.Errorf("Expected the answer to cite remote.md, got %v", res.Sources)
+	}
+}
+
+func TestFill(t *testing.T) {
+	srv := testServer(t)
+	addDocuments(t, srv)
+
+	var res fillResponse
+	status := post(t, srv, "/fill", fillRequest{
+		Headers: []string{"question"},
+		Rows:    [][]string{{"how many vacation days per year?"}, {"is remote work allowed?"}},
+	}, &res)
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if len(res.Rows) != 2 {
+		t.Fatalf("Expected an answer per row, got %v", res.Rows)
+	}
+	for i, want := range []string{"vacation.md", "remote.md"} {
+		if len(res.Rows[i].Sources) != 1 || res.Rows[i].Sources[0].Name != want {
+			t.Errorf("Row %d: expected the answer to cite %s, got %v", i, want, res.Rows[i].Sources)
+		}
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	srv := testServer(t)
+
+	tests := []struct {
+		name   string
+		path   string
+		body   any
+		status int
+		err    string
+	}{
+		{name: "invalid json", path: "/search", body: `{"question":`, status: http.StatusBadRequest, err: "failed to decode request"},
+		{name: "add without name", path: "/add", body: addRequest{Content: "text"}, status: http.StatusBadRequest, err: "name is required"},
+		{name: "unknown mode", path: "/search", body: `{"question":"q","mode":"fuzzy"}`, status: http.StatusBadRequest, err: "unknown search mode"},
+		{name: "unknown metric", path: "/prompt", body: `{"question":"q","metric":"hamming"}`, status: http.StatusBadRequest, err: "hamming"},
+		{name: "min score in lexical mode", path: "/search", body: `{"question":"q","mode":"lexical","min_score":0.5}`, status: http.StatusBadRequest, err: "a min score can not be used in lexical mode"},
+		{name: "mmr lambda out of range", path: "/fill", body: `{"rows":[["q"]],"mmr_lambda":2}`, status: http.StatusBadRequest, err: "mmr lambda must be in [0, 1]"},
+		{
+			name:   "too large",
+			path:   "/add",
+			body:   addRequest{Name: "large.md", Content: string(bytes.Repeat([]byte("a"), maxRequestBytes))},
+			status: http.StatusRequestEntityTooLarge,
+			err:    "request is larger than",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res map[string]string
+			status := post(t, srv, tt.path, tt.body, &res)
+			if status != tt.status {
+				t.Errorf("Expected %d, got %d", tt.status, status)
+			}
+			if !strings.Contains(res["error"], tt.err) {
+				t.Errorf("Expected an error containing %q, got %q", tt.err, res["error"])
+			}
+		})
+	}
+
+	resp, err := http.Get(srv.URL + "/search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET /search to be refused with 405, got %d", resp.StatusCode)
+	}
+}
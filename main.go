@@ -5,18 +5,25 @@ import (
 	"encoding/csv"
 	"fmt"
 	"github.com/MatusOllah/slogcolor"
-	"github.com/disintegrator/inv"
 	"github.com/modfin/bellman/models/embed"
 	"github.com/modfin/blot/internal/ai"
+	"github.com/modfin/blot/internal/chat"
+	"github.com/modfin/blot/internal/db"
 	"github.com/modfin/blot/internal/db/vec"
+	"github.com/modfin/blot/internal/server"
+	"github.com/modfin/henry/slicez"
 	"github.com/urfave/cli/v3"
 	"io"
 	"log/slog"
 	_ "modernc.org/sqlite"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"reflect"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 //TIP <p>To run your code, right-click the code and select <b>Run</b>.</p> <p>Alternatively, click
@@ -91,6 +98,11 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 				Name:    "voyageai-key",
 				Sources: cli.EnvVars("BLOT_VOYAGEAI_KEY"),
 			},
+			&cli.StringFlag{
+				Name:    "ollama-url",
+				Usage:   "url of an Ollama server, or any server implementing its api, for local models, eg. --ollama-url=http://localhost:11434",
+				Sources: cli.EnvVars("BLOT_OLLAMA_URL"),
+			},
 
 			&cli.StringFlag{
 				Name:    "embed-model",
@@ -98,11 +110,48 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 				Sources: cli.EnvVars("BLOT_EMBED_MODEL"),
 			},
 			&cli.StringFlag{
-				Name:    "llm-model",
+				Name: "llm-model",
+				Usage: "the llm, optionally followed by comma separated fallbacks that are prompted in order if it fails, \n" +
+					"eg. --llm-model=OpenAI/gpt-4o-mini,Anthropic/claude-3-5-haiku-latest",
 				Value:   "OpenAI/gpt-4o-mini",
 				Sources: cli.EnvVars("BLOT_LLM_MODEL"),
 			},
 
+			&cli.StringSliceFlag{
+				Name: "rate-limit",
+				Usage: "the maximum number of requests per minute to a provider, \n" +
+					"eg. --rate-limit=OpenAI:500 --rate-limit=Anthropic:50",
+				Sources: cli.EnvVars("BLOT_RATE_LIMITS"),
+			},
+			&cli.IntFlag{
+				Name:    "retries",
+				Usage:   "the number of times a request is retried when a provider is rate limiting, has an internal error or can not be reached",
+				Value:   3,
+				Sources: cli.EnvVars("BLOT_RETRIES"),
+			},
+			&cli.DurationFlag{
+				Name:    "retry-backoff",
+				Usage:   "the wait before the first retry, which doubles for every following retry, with jitter",
+				Value:   time.Second,
+				Sources: cli.EnvVars("BLOT_RETRY_BACKOFF"),
+			},
+
+			&cli.StringFlag{
+				Name: "vector-encoding",
+				Usage: "how to store embedding vectors, float64, float32, int8 or binary. \n" +
+					"int8 and binary are quantized, taking a quarter and a thirty-second of the space of float32, \n" +
+					"at the cost of some precision",
+				Value:   "float32",
+				Sources: cli.EnvVars("BLOT_VECTOR_ENCODING"),
+			},
+			&cli.BoolFlag{
+				Name: "embed-cache",
+				Usage: "cache embedded questions in the database, such that repeated questions are not embedded again, \n" +
+					"disable with --embed-cache=false",
+				Value:   true,
+				Sources: cli.EnvVars("BLOT_EMBED_CACHE"),
+			},
+
 			&cli.BoolFlag{
 				Name:    "verbose",
 				Sources: cli.EnvVars("BLOT_VERBOSE"),
@@ -221,6 +270,497 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 					return nil
 				},
 			},
+			{
+				Name:  "ls",
+				Usage: "lists the fragments in the knowledge base",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "label",
+						Usage: "only list fragments with the label",
+					},
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "only list fragments where the name or document matches the glob pattern, eg. --name='policies/*'",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					frags, err := cfg.Dao.ListFragments(ctx, db.ListFragmentsParams{
+						Label: cmd.String("label"),
+						Name:  cmd.String("name"),
+					})
+					if err != nil {
+						return fmt.Errorf("failed to list fragments: %w", err)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "ID\tLABEL\tNAME\tCHARS\tEMBEDDING MODEL\tUPDATED")
+					for _, frag := range frags {
+						fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n",
+							frag.ID, frag.Label, frag.Name, len([]rune(frag.Content)), frag.EmbeddingModel,
+							time.Unix(int64(frag.UpdatedAt), 0).Format(time.DateTime))
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:      "show",
+				Usage:     "shows the content and metadata of a fragment",
+				ArgsUsage: "<id|name>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "label",
+						Usage: "the label of the fragment, when shown by name",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					arg := cmd.Args().First()
+					if arg == "" {
+						return fmt.Errorf("expected a fragment id or name")
+					}
+
+					var ids []int
+					if id, err := strconv.Atoi(arg); err == nil {
+						ids = append(ids, id)
+					} else {
+						frags, err := cfg.Dao.ListFragments(ctx, db.ListFragmentsParams{Label: cmd.String("label"), Name: arg})
+						if err != nil {
+							return fmt.Errorf("failed to find fragment: %w", err)
+						}
+						ids = slicez.Map(frags, func(f db.Fragment) int { return f.ID })
+					}
+					if len(ids) == 0 {
+						return fmt.Errorf("no fragment found for '%s'", arg)
+					}
+
+					for i, id := range ids {
+						frag, err := cfg.Dao.GetFragment(ctx, id)
+						if err != nil {
+							return fmt.Errorf("failed to get fragment %d: %w", id, err)
+						}
+						if i > 0 {
+							fmt.Println()
+						}
+						fmt.Printf("id:               %d\n", frag.ID)
+						fmt.Printf("label:            %s\n", frag.Label)
+						fmt.Printf("name:             %s\n", frag.Name)
+						fmt.Printf("document:         %s\n", frag.Document)
+						fmt.Printf("chunk:            %d\n", frag.ChunkIndex)
+						fmt.Printf("embedding model:  %s\n", frag.EmbeddingModel)
+						fmt.Printf("dimensions:       %d\n", len(frag.EmbeddingVector))
+						fmt.Printf("created:          %s\n", time.Unix(int64(frag.CreatedAt), 0).Format(time.DateTime))
+						fmt.Printf("updated:          %s\n", time.Unix(int64(frag.UpdatedAt), 0).Format(time.DateTime))
+						fmt.Println()
+						fmt.Println(frag.Content)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "rm",
+				Usage: "removes fragments from the knowledge base, matching all of the given filters",
+				Flags: []cli.Flag{
+					&cli.IntSliceFlag{
+						Name:  "id",
+						Usage: "remove the fragment with the id, may be given several times",
+					},
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "remove fragments where the name or document matches the glob pattern",
+					},
+					&cli.StringFlag{
+						Name:  "label",
+						Usage: "remove fragments with the label",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					removed, err := cfg.Dao.DeleteFragments(ctx, db.DeleteFragmentsParams{
+						IDs:   slicez.Map(cmd.IntSlice("id"), func(id int64) int { return int(id) }),
+						Label: cmd.String("label"),
+						Name:  cmd.String("name"),
+					})
+					if err != nil {
+						return fmt.Errorf("failed to remove fragments: %w", err)
+					}
+					slog.Default().Info("Removed fragments", "count", removed)
+					return nil
+				},
+			},
+			{
+				Name:  "labels",
+				Usage: "lists the labels in the knowledge base, with the number of fragments and documents",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					labels, err := cfg.Dao.Labels(ctx)
+					if err != nil {
+						return fmt.Errorf("failed to list labels: %w", err)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "LABEL\tFRAGMENTS\tDOCUMENTS")
+					for _, l := range labels {
+						fmt.Fprintf(w, "%s\t%d\t%d\n", l.Label, l.Fragments, l.Documents)
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "models",
+				Usage: "lists the embedding models in the knowledge base, with the number of fragments embedded by each",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					models, err := cfg.Dao.EmbeddingModels(ctx)
+					if err != nil {
+						return fmt.Errorf("failed to list embedding models: %w", err)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "EMBEDDING MODEL\tFRAGMENTS\tMETRIC")
+					for _, m := range models {
+						fmt.Fprintf(w, "%s\t%d\t%s\n", m.EmbeddingModel, m.Fragments, m.Metric)
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "sessions",
+				Usage: "manages the chat sessions persisted by chat --session and prompt --session",
+				Commands: []*cli.Command{
+					{
+						Name:    "ls",
+						Aliases: []string{"list"},
+						Usage:   "lists the sessions, most recently updated first",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							cfg, err := ai.LoadConf(ctx, cmd)
+							if err != nil {
+								return fmt.Errorf("failed to load config: %w", err)
+							}
+
+							sessions, err := cfg.Dao.Sessions(ctx)
+							if err != nil {
+								return fmt.Errorf("failed to list sessions: %w", err)
+							}
+
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "NAME\tTURNS\tINPUT TOKENS\tOUTPUT TOKENS\tTOTAL TOKENS\tUPDATED")
+							for _, s := range sessions {
+								fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n",
+									s.Name, s.Turns, s.InputTokens, s.OutputTokens, s.TotalTokens,
+									time.Unix(int64(s.UpdatedAt), 0).Format(time.DateTime))
+							}
+							return w.Flush()
+						},
+					},
+					{
+						Name:      "show",
+						Usage:     "shows the turns of a session",
+						ArgsUsage: "<name>",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							cfg, err := ai.LoadConf(ctx, cmd)
+							if err != nil {
+								return fmt.Errorf("failed to load config: %w", err)
+							}
+
+							transcript, err := chat.LoadTranscript(ctx, cfg.Dao, cmd.Args().First())
+							if err != nil {
+								return err
+							}
+							return transcript.Markdown(os.Stdout)
+						},
+					},
+					{
+						Name:      "export",
+						Usage:     "exports a session, with its turns, retrieved fragment ids and token usage, to stdout",
+						ArgsUsage: "<name>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "the format to export in, json or markdown",
+								Value: "json",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							cfg, err := ai.LoadConf(ctx, cmd)
+							if err != nil {
+								return fmt.Errorf("failed to load config: %w", err)
+							}
+
+							transcript, err := chat.LoadTranscript(ctx, cfg.Dao, cmd.Args().First())
+							if err != nil {
+								return err
+							}
+							switch cmd.String("format") {
+							case "json":
+								return transcript.JSON(os.Stdout)
+							case "markdown":
+								return transcript.Markdown(os.Stdout)
+							default:
+								return fmt.Errorf("unknown format '%s', expected json or markdown", cmd.String("format"))
+							}
+						},
+					},
+					{
+						Name:      "rm",
+						Aliases:   []string{"delete"},
+						Usage:     "deletes a session and its turns",
+						ArgsUsage: "<name>",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							cfg, err := ai.LoadConf(ctx, cmd)
+							if err != nil {
+								return fmt.Errorf("failed to load config: %w", err)
+							}
+
+							name := cmd.Args().First()
+							deleted, err := ai.DeleteSession(cfg, name)
+							if err != nil {
+								return err
+							}
+							if !deleted {
+								return fmt.Errorf("no session named '%s'", name)
+							}
+							slog.Default().Info("Deleted session", "name", name)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "manages the cache of embedded questions",
+				Commands: []*cli.Command{
+					{
+						Name:    "info",
+						Aliases: []string{"ls"},
+						Usage:   "shows the number of cached embeddings, and their size, per embedding model",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							cfg, err := ai.LoadConf(ctx, cmd)
+							if err != nil {
+								return fmt.Errorf("failed to load config: %w", err)
+							}
+
+							stats, err := cfg.Dao.EmbeddingCacheStats(ctx)
+							if err != nil {
+								return fmt.Errorf("failed to read embedding cache: %w", err)
+							}
+
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "EMBED MODEL\tENTRIES\tBYTES\tOLDEST\tNEWEST")
+							for _, s := range stats {
+								fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n",
+									s.EmbeddingModel, s.Entries, s.Bytes,
+									time.Unix(int64(s.OldestAt), 0).Format(time.DateTime),
+									time.Unix(int64(s.NewestAt), 0).Format(time.DateTime))
+							}
+							return w.Flush()
+						},
+					},
+					{
+						Name:  "clear",
+						Usage: "deletes the cached embeddings, of all models or of the --model",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "model",
+								Usage: "only clear the embeddings of the model, eg. --model=OpenAI/text-embedding-3-small",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							cfg, err := ai.LoadConf(ctx, cmd)
+							if err != nil {
+								return fmt.Errorf("failed to load config: %w", err)
+							}
+
+							deleted, err := cfg.Dao.ClearEmbeddingCache(ctx, cmd.String("model"))
+							if err != nil {
+								return fmt.Errorf("failed to clear embedding cache: %w", err)
+							}
+							slog.Default().Info("Cleared embedding cache", "deleted", deleted)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "usage",
+				Usage: "reports the tokens used, and their cost, by the requests to models, by day, model and command",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "by",
+						Usage: "what to sum the usage by, day, model, command or kind, eg. --by=day --by=model",
+						Value: []string{"day", "model", "command"},
+					},
+					&cli.IntFlag{
+						Name:  "days",
+						Usage: "the number of days back to report, including today, 0 reports all usage",
+						Value: 30,
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					var since int
+					if days := cmd.Int("days"); days > 0 {
+						now := time.Now()
+						since = int(time.Date(now.Year(), now.Month(), now.Day()-int(days)+1, 0, 0, 0, 0, time.Local).Unix())
+					}
+					usage, err := cfg.Dao.UsageReport(ctx, db.UsageReportParams{Since: since, By: cmd.StringSlice("by")})
+					if err != nil {
+						return fmt.Errorf("failed to report usage: %w", err)
+					}
+
+					groups := map[string]func(u db.Usage) string{
+						"day":     func(u db.Usage) string { return u.Day },
+						"model":   func(u db.Usage) string { return u.Model },
+						"command": func(u db.Usage) string { return u.Command },
+						"kind":    func(u db.Usage) string { return u.Kind },
+					}
+					by := cmd.StringSlice("by")
+
+					var total db.Usage
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					for _, b := range by {
+						fmt.Fprintf(w, "%s\t", strings.ToUpper(b))
+					}
+					fmt.Fprintln(w, "REQUESTS\tERRORS\tINPUT TOKENS\tOUTPUT TOKENS\tAVG LATENCY\tCOST")
+					for _, u := range usage {
+						for _, b := range by {
+							fmt.Fprintf(w, "%s\t", groups[b](u))
+						}
+						fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%dms\t$%.4f\n", u.Requests, u.Errors, u.InputTokens, u.OutputTokens, u.LatencyMs, u.Cost)
+						total.Requests += u.Requests
+						total.Errors += u.Errors
+						total.InputTokens += u.InputTokens
+						total.OutputTokens += u.OutputTokens
+						total.Cost += u.Cost
+					}
+					fmt.Fprintf(w, "TOTAL\t%s%d\t%d\t%d\t%d\t\t$%.4f\n", strings.Repeat("\t", max(len(by)-1, 0)),
+						total.Requests, total.Errors, total.InputTokens, total.OutputTokens, total.Cost)
+					return w.Flush()
+				},
+				Commands: []*cli.Command{
+					{
+						Name:  "prices",
+						Usage: "lists the prices of models, in USD per million tokens, which the cost of requests is calculated by",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+
+							cfg, err := ai.LoadConf(ctx, cmd)
+							if err != nil {
+								return fmt.Errorf("failed to load config: %w", err)
+							}
+
+							prices, err := cfg.Dao.ModelPrices(ctx)
+							if err != nil {
+								return fmt.Errorf("failed to list prices: %w", err)
+							}
+
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "MODEL\tINPUT\tOUTPUT\tUPDATED")
+							for _, p := range prices {
+								fmt.Fprintf(w, "%s\t$%g\t$%g\t%s\n",
+									p.Model, p.InputPrice, p.OutputPrice,
+									time.Unix(int64(p.UpdatedAt), 0).Format(time.DateTime))
+							}
+							return w.Flush()
+						},
+						Commands: []*cli.Command{
+							{
+								Name:      "set",
+								Usage:     "sets the price of a model, in USD per million tokens",
+								ArgsUsage: "<model>",
+								Flags: []cli.Flag{
+									&cli.FloatFlag{
+										Name:     "input",
+										Usage:    "the price of a million input tokens",
+										Required: true,
+									},
+									&cli.FloatFlag{
+										Name:  "output",
+										Usage: "the price of a million output tokens",
+									},
+								},
+								Action: func(ctx context.Context, cmd *cli.Command) error {
+
+									cfg, err := ai.LoadConf(ctx, cmd)
+									if err != nil {
+										return fmt.Errorf("failed to load config: %w", err)
+									}
+
+									model := cmd.Args().First()
+									if !strings.Contains(model, "/") {
+										return fmt.Errorf("expected a model on the form <provider>/<model>, eg. OpenAI/gpt-4o-mini")
+									}
+									err = cfg.Dao.SetModelPrice(ctx, model, cmd.Float("input"), cmd.Float("output"))
+									if err != nil {
+										return fmt.Errorf("failed to set price of %s: %w", model, err)
+									}
+									slog.Default().Info("Set price", "model", model, "input", cmd.Float("input"), "output", cmd.Float("output"))
+									return nil
+								},
+							},
+							{
+								Name:      "rm",
+								Aliases:   []string{"delete"},
+								Usage:     "deletes the price of a model, whose requests are then free as far as the ledger is concerned",
+								ArgsUsage: "<model>",
+								Action: func(ctx context.Context, cmd *cli.Command) error {
+
+									cfg, err := ai.LoadConf(ctx, cmd)
+									if err != nil {
+										return fmt.Errorf("failed to load config: %w", err)
+									}
+
+									model := cmd.Args().First()
+									deleted, err := cfg.Dao.DeleteModelPrice(ctx, model)
+									if err != nil {
+										return fmt.Errorf("failed to delete price of %s: %w", model, err)
+									}
+									if !deleted {
+										return fmt.Errorf("no price for model '%s'", model)
+									}
+									slog.Default().Info("Deleted price", "model", model)
+									return nil
+								},
+							},
+						},
+					},
+				},
+			},
 			{
 
 				Name:      "add",
@@ -233,6 +773,55 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 						Value:   "default",
 						Sources: cli.EnvVars("BLOT_LABEL"),
 					},
+					&cli.BoolFlag{
+						Name: "prune",
+						Usage: "sync the label with the given files, by removing the fragments of files \n" +
+							"with the label that are not given, eg. deleted or renamed files",
+						Sources: cli.EnvVars("BLOT_PRUNE"),
+					},
+					&cli.BoolFlag{
+						Name:    "dry-run",
+						Usage:   "together with --prune, list the files that would be removed without changing anything",
+						Sources: cli.EnvVars("BLOT_DRY_RUN"),
+					},
+					&cli.StringFlag{
+						Name: "chunk-strategy",
+						Usage: "how to split files into fragments, none, fixed, paragraph or markdown. \n" +
+							"fixed cuts the file into overlapping windows, paragraph packs paragraphs \n" +
+							"and markdown cuts at headings, into fragments of at most --chunk-size characters",
+						Value:   "paragraph",
+						Sources: cli.EnvVars("BLOT_CHUNK_STRATEGY"),
+					},
+					&cli.IntFlag{
+						Name:    "chunk-size",
+						Usage:   "the maximum number of characters in a fragment",
+						Value:   4000,
+						Sources: cli.EnvVars("BLOT_CHUNK_SIZE"),
+					},
+					&cli.IntFlag{
+						Name:    "chunk-overlap",
+						Usage:   "the number of characters that a fragment overlaps the previous one, when cut within a paragraph",
+						Value:   200,
+						Sources: cli.EnvVars("BLOT_CHUNK_OVERLAP"),
+					},
+					&cli.IntFlag{
+						Name:    "embed-batch-size",
+						Usage:   "the maximum number of fragments to embed in one request",
+						Value:   64,
+						Sources: cli.EnvVars("BLOT_EMBED_BATCH_SIZE"),
+					},
+					&cli.IntFlag{
+						Name:    "embed-batch-tokens",
+						Usage:   "the maximum number of tokens, estimated as characters / 4, to embed in one request",
+						Value:   60000,
+						Sources: cli.EnvVars("BLOT_EMBED_BATCH_TOKENS"),
+					},
+					&cli.StringFlag{
+						Name: "metric",
+						Usage: "the distance metric, cosine, dot, euclidean or manhattan, to record for the embedding model \n" +
+							"when its first fragments are added (default: cosine)",
+						Sources: cli.EnvVars("BLOT_METRIC"),
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 
@@ -241,70 +830,150 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 						return fmt.Errorf("failed to load config: %w", err)
 					}
 
-					model := cfg.EmbedModel
-					model.Type = embed.TypeDocument
+					label := cmd.String("label")
 
+					var docs []ai.Document
 					for _, f := range cmd.Args().Slice() {
-						logger := slog.Default().With("file", f)
-
-						logger.Debug("reading file")
+						slog.Default().Debug("reading file", "file", f)
 
-						in, err := os.Open(f)
-						if err != nil {
-							return fmt.Errorf("failed to open file %s: %w", f, err)
-						}
-
-						data, err := io.ReadAll(in)
+						data, err := os.ReadFile(f)
 						if err != nil {
 							return fmt.Errorf("failed to read file %s: %w", f, err)
 						}
-						in.Close()
 
-						label := cmd.String("label")
-						name := filepath.Clean(f)
-						content := string(data)
+						docs = append(docs, ai.Document{
+							Label:   label,
+							Name:    filepath.Clean(f),
+							Content: string(data),
+						})
+					}
 
-						dirty, err := cfg.Dao.DirtyFragment(ctx, label, name, content)
+					if cmd.Bool("dry-run") {
+						if !cmd.Bool("prune") {
+							return fmt.Errorf("--dry-run only applies to --prune")
+						}
+						stale, err := ai.Prune(cfg, label, slicez.Map(docs, func(d ai.Document) string { return d.Name }), true)
 						if err != nil {
-							return fmt.Errorf("failed to check fragment dirty state for %s with label %s: %w", name, label, err)
+							return err
 						}
-						if !dirty {
-							logger.Debug("skipping already existing fragment")
-							continue
+						for _, document := range stale {
+							fmt.Println("would remove", document)
 						}
+						return nil
+					}
 
-						logger = logger.With("name", name, "label", label)
-						logger.Debug("embedding file", "len", len(content))
-						resp, err := cfg.Proxy.Embed(embed.Request{
-							Ctx:   ctx,
-							Model: model,
-							Text:  content,
-						})
+					frags, err := ai.AddDocuments(cfg, docs)
+					for _, frag := range frags {
+						slog.Default().Info("Added fragment", "id", frag.ID, "name", frag.Name, "label", frag.Label)
+					}
+					if err != nil {
+						return err
+					}
 
+					if cmd.Bool("prune") {
+						stale, err := ai.Prune(cfg, label, slicez.Map(docs, func(d ai.Document) string { return d.Name }), false)
 						if err != nil {
-							return fmt.Errorf("failed to embed: %w", err)
+							return err
 						}
-						embeddingVector := resp.AsFloat64()
+						for _, document := range stale {
+							slog.Default().Info("Removed document", "document", document, "label", label)
+						}
+					}
 
-						logger.Debug("adding embedding to database")
-						frag, err := cfg.Dao.AddFragment(context.Background(),
-							label,
-							name,
-							content,
-							model.String(),
-							embeddingVector,
-						)
+					return ai.EnsureIndex(cfg)
+				},
+			},
+			{
+				Name: "index",
+				Usage: "rebuilds the approximate nearest neighbour index of the embedding model. \n" +
+					"add builds the index once the knowledge base is large enough and lists new fragments in it, \n" +
+					"but as the knowledge base grows the index should be rebuilt to keep the lists balanced",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 
-						if err != nil {
-							return fmt.Errorf("failed to add fragment: %w", err)
-						}
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					centroids, err := ai.BuildIndex(cfg)
+					if err != nil {
+						return fmt.Errorf("failed to build index: %w", err)
+					}
+					slog.Default().Info("Built index", "embed-model", cfg.EmbedModel.String(), "lists", centroids)
+					return nil
+				},
+			},
+			{
+				Name: "reencode",
+				Usage: "stores the vectors of the --embed-model using the --vector-encoding, eg. to shrink the database \n" +
+					"by quantizing vectors. Quantized vectors does not regain their precision when encoded as floats",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 
-						inv.Require("resulting embedding must mach original",
-							"vectors shall be equal", reflect.DeepEqual(embeddingVector, frag.EmbeddingVector))
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					n, err := ai.Reencode(cfg)
+					if err != nil {
+						return fmt.Errorf("failed to encode vectors: %w", err)
+					}
+					slog.Default().Info("Encoded vectors", "encoding", cmd.String("vector-encoding"), "fragments", n)
+					return nil
+				},
+			},
+			{
+				Name: "reembed",
+				Usage: "embeds the fragments of the --embed-model with another model, keeping the old fragments \n" +
+					"until --cutover. An interrupted run continues where it stopped when run again",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "to",
+						Usage:    "the embedding model to embed the fragments with, eg. VoyageAI/voyage-3",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "label",
+						Usage: "only embed fragments with the label",
+					},
+					&cli.BoolFlag{
+						Name:  "cutover",
+						Usage: "remove the fragments of the --embed-model once all of them are embedded with the new model",
+					},
+					&cli.IntFlag{
+						Name:    "embed-batch-size",
+						Usage:   "the maximum number of fragments to embed in one request",
+						Value:   64,
+						Sources: cli.EnvVars("BLOT_EMBED_BATCH_SIZE"),
+					},
+					&cli.IntFlag{
+						Name:    "embed-batch-tokens",
+						Usage:   "the maximum number of tokens, estimated as characters / 4, to embed in one request",
+						Value:   60000,
+						Sources: cli.EnvVars("BLOT_EMBED_BATCH_TOKENS"),
+					},
+					&cli.StringFlag{
+						Name: "metric",
+						Usage: "the distance metric, cosine, dot, euclidean or manhattan, to record for the embedding model \n" +
+							"when its first fragments are added (default: cosine)",
+						Sources: cli.EnvVars("BLOT_METRIC"),
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 
-						logger.Info("Added fragment", "id", frag.ID)
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
 					}
 
+					provider, name, _ := strings.Cut(cmd.String("to"), "/")
+					to := embed.Model{Provider: provider, Name: name}
+
+					n, err := ai.Reembed(cfg, to, cmd.String("label"), cmd.Bool("cutover"))
+					if err != nil {
+						return fmt.Errorf("failed to re-embed fragments: %w", err)
+					}
+					slog.Default().Info("Re-embedded fragments", "to", to.String(), "fragments", n)
 					return nil
 				},
 			},
@@ -325,6 +994,55 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 						Value:   []string{"5"},
 						Sources: cli.EnvVars("BLOT_LIMITS"),
 					},
+					&cli.StringFlag{
+						Name: "mode",
+						Usage: "how to rank fragments, vector, lexical or hybrid. \n" +
+							"vector ranks by embedding similarity, lexical by bm25 full text search \n" +
+							"and hybrid fuses both rankings",
+						Value:   "vector",
+						Sources: cli.EnvVars("BLOT_MODE"),
+					},
+					&cli.BoolFlag{
+						Name:    "exact",
+						Usage:   "search all fragments instead of probing the approximate nearest neighbour index",
+						Sources: cli.EnvVars("BLOT_EXACT"),
+					},
+					&cli.IntFlag{
+						Name:    "probes",
+						Usage:   "the number of index lists to search, more probes are slower but more accurate",
+						Value:   8,
+						Sources: cli.EnvVars("BLOT_PROBES"),
+					},
+					&cli.StringFlag{
+						Name: "metric",
+						Usage: "the distance metric, cosine, dot, euclidean or manhattan, \n" +
+							"defaults to the metric recorded for the embedding model",
+						Sources: cli.EnvVars("BLOT_METRIC"),
+					},
+					&cli.FloatFlag{
+						Name: "min-score",
+						Usage: "drop fragments scoring below the minimum, eg. the cosine similarity in vector mode, or the relevance \n" +
+							"in [0, 1] when reranked. Not supported for lexical and hybrid mode without reranking",
+						Sources: cli.EnvVars("BLOT_MIN_SCORE"),
+					},
+					&cli.StringFlag{
+						Name: "rerank-model",
+						Usage: "rerank the retrieved fragments with a model, eg. VoyageAI/rerank-2, or any llm, \n" +
+							"eg. OpenAI/gpt-4o-mini, which is prompted to grade the fragments",
+						Sources: cli.EnvVars("BLOT_RERANK_MODEL"),
+					},
+					&cli.IntFlag{
+						Name:    "rerank-candidates",
+						Usage:   "the number of fragments per label to retrieve and rerank, of which --limit are kept",
+						Value:   20,
+						Sources: cli.EnvVars("BLOT_RERANK_CANDIDATES"),
+					},
+					&cli.FloatFlag{
+						Name: "mmr-lambda",
+						Usage: "diversify the fragments of each label by maximal marginal relevance, trading relevance, 1, \n" +
+							"against novelty, 0, eg. 0.5 to avoid near duplicates. Not diversified by default",
+						Sources: cli.EnvVars("BLOT_MMR_LAMBDA"),
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 
@@ -340,8 +1058,8 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 						return fmt.Errorf("failed to Search: %w", err)
 					}
 					for _, frag := range fragments {
-						slog.Default().Debug("Found fragment", "id", frag.ID, "label", frag.Label, "name", frag.Name)
-						fmt.Println(frag.Name)
+						slog.Default().Debug("Found fragment", "id", frag.ID, "label", frag.Label, "name", frag.Name, "score", frag.Score)
+						fmt.Printf("%.4f\t%s\n", frag.Score, frag.Name)
 						if cmd.Bool("emit") {
 							fmt.Println(frag.Content)
 						}
@@ -369,6 +1087,65 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 						Value:   []string{"5"},
 						Sources: cli.EnvVars("BLOT_LIMITS"),
 					},
+					&cli.StringFlag{
+						Name: "mode",
+						Usage: "how to rank fragments, vector, lexical or hybrid. \n" +
+							"vector ranks by embedding similarity, lexical by bm25 full text search \n" +
+							"and hybrid fuses both rankings",
+						Value:   "vector",
+						Sources: cli.EnvVars("BLOT_MODE"),
+					},
+					&cli.BoolFlag{
+						Name:    "exact",
+						Usage:   "search all fragments instead of probing the approximate nearest neighbour index",
+						Sources: cli.EnvVars("BLOT_EXACT"),
+					},
+					&cli.IntFlag{
+						Name:    "probes",
+						Usage:   "the number of index lists to search, more probes are slower but more accurate",
+						Value:   8,
+						Sources: cli.EnvVars("BLOT_PROBES"),
+					},
+					&cli.StringFlag{
+						Name: "metric",
+						Usage: "the distance metric, cosine, dot, euclidean or manhattan, \n" +
+							"defaults to the metric recorded for the embedding model",
+						Sources: cli.EnvVars("BLOT_METRIC"),
+					},
+					&cli.FloatFlag{
+						Name: "min-score",
+						Usage: "drop fragments scoring below the minimum, eg. the cosine similarity in vector mode, or the relevance \n" +
+							"in [0, 1] when reranked. Not supported for lexical and hybrid mode without reranking",
+						Sources: cli.EnvVars("BLOT_MIN_SCORE"),
+					},
+					&cli.StringFlag{
+						Name: "rerank-model",
+						Usage: "rerank the retrieved fragments with a model, eg. VoyageAI/rerank-2, or any llm, \n" +
+							"eg. OpenAI/gpt-4o-mini, which is prompted to grade the fragments",
+						Sources: cli.EnvVars("BLOT_RERANK_MODEL"),
+					},
+					&cli.IntFlag{
+						Name:    "rerank-candidates",
+						Usage:   "the number of fragments per label to retrieve and rerank, of which --limit are kept",
+						Value:   20,
+						Sources: cli.EnvVars("BLOT_RERANK_CANDIDATES"),
+					},
+					&cli.FloatFlag{
+						Name: "mmr-lambda",
+						Usage: "diversify the fragments of each label by maximal marginal relevance, trading relevance, 1, \n" +
+							"against novelty, 0, eg. 0.5 to avoid near duplicates. Not diversified by default",
+						Sources: cli.EnvVars("BLOT_MMR_LAMBDA"),
+					},
+					&cli.StringFlag{
+						Name:  "session",
+						Usage: "continue the named chat session, answering the question in the light of its previous turns, creating it if it does not exist",
+					},
+					&cli.BoolFlag{
+						Name: "stream",
+						Usage: "print the answer as it is generated, which is followed by its sources once it is done. \n" +
+							"Streams with OpenAI, Anthropic and Ollama, other providers print the answer once it is done",
+						Sources: cli.EnvVars("BLOT_STREAM"),
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 
@@ -378,9 +1155,32 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 					}
 					question := strings.Join(cmd.Args().Slice(), " ")
 
-					ans, err := ai.Query(cfg, question)
-					if err != nil {
-						return fmt.Errorf("failed to Query: %w", err)
+					stream := cmd.Bool("stream")
+					var ans ai.Answer
+					switch {
+					case cmd.IsSet("session"):
+						conversation, err := ai.OpenSession(cfg, cmd.String("session"))
+						if err != nil {
+							return err
+						}
+						if stream {
+							ans, err = conversation.AskStream(cfg, question, os.Stdout)
+						} else {
+							ans, err = conversation.Ask(cfg, question)
+						}
+						if err != nil {
+							return fmt.Errorf("failed to Ask: %w", err)
+						}
+					case stream:
+						ans, err = ai.QueryStream(cfg, question, os.Stdout)
+						if err != nil {
+							return fmt.Errorf("failed to Query: %w", err)
+						}
+					default:
+						ans, err = ai.Query(cfg, question)
+						if err != nil {
+							return fmt.Errorf("failed to Query: %w", err)
+						}
 					}
 
 					slog.Default().Debug("llm statistics",
@@ -391,11 +1191,231 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 						"confidence", ans.ConfidenceScore,
 					)
 
-					fmt.Println(ans.Answer)
+					if stream {
+						fmt.Println() // the answer is already printed
+					} else {
+						fmt.Println(ans.Answer)
+					}
+					if len(ans.Citations) > 0 {
+						fmt.Println()
+						fmt.Println("Sources:")
+						for _, frag := range ans.Citations {
+							fmt.Printf("  - %s\n", frag.Name)
+						}
+					}
 
 					return nil
 				},
 			},
+			{
+				Name: "chat",
+				Usage: "chat with the knowledge base, where follow up questions are answered in the light of the \n" +
+					"conversation. /help lists the commands that changes limits, labels or model mid conversation",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "system-prompt",
+						Usage:   "the system prompt to use that will be used for the prompt when RAGing.",
+						Sources: cli.EnvVars("BLOT_SYSTEM_PROMPT"),
+					},
+					&cli.StringSliceFlag{
+						Name: "limit",
+						Usage: "the maximum number of documents to that is used for the prompt when RAGing. \n" +
+							"eg. --limit=5, but can be further broken down by label.\n" +
+							"--limit=QA:3 --limit=policies:2 --limit=procedures:1. \n" +
+							"Resulting in 6 fragments returned ",
+						Value:   []string{"5"},
+						Sources: cli.EnvVars("BLOT_LIMITS"),
+					},
+					&cli.StringFlag{
+						Name: "mode",
+						Usage: "how to rank fragments, vector, lexical or hybrid. \n" +
+							"vector ranks by embedding similarity, lexical by bm25 full text search \n" +
+							"and hybrid fuses both rankings",
+						Value:   "vector",
+						Sources: cli.EnvVars("BLOT_MODE"),
+					},
+					&cli.BoolFlag{
+						Name:    "exact",
+						Usage:   "search all fragments instead of probing the approximate nearest neighbour index",
+						Sources: cli.EnvVars("BLOT_EXACT"),
+					},
+					&cli.IntFlag{
+						Name:    "probes",
+						Usage:   "the number of index lists to search, more probes are slower but more accurate",
+						Value:   8,
+						Sources: cli.EnvVars("BLOT_PROBES"),
+					},
+					&cli.StringFlag{
+						Name: "metric",
+						Usage: "the distance metric, cosine, dot, euclidean or manhattan, \n" +
+							"defaults to the metric recorded for the embedding model",
+						Sources: cli.EnvVars("BLOT_METRIC"),
+					},
+					&cli.FloatFlag{
+						Name: "min-score",
+						Usage: "drop fragments scoring below the minimum, eg. the cosine similarity in vector mode, or the relevance \n" +
+							"in [0, 1] when reranked. Not supported for lexical and hybrid mode without reranking",
+						Sources: cli.EnvVars("BLOT_MIN_SCORE"),
+					},
+					&cli.StringFlag{
+						Name: "rerank-model",
+						Usage: "rerank the retrieved fragments with a model, eg. VoyageAI/rerank-2, or any llm, \n" +
+							"eg. OpenAI/gpt-4o-mini, which is prompted to grade the fragments",
+						Sources: cli.EnvVars("BLOT_RERANK_MODEL"),
+					},
+					&cli.IntFlag{
+						Name:    "rerank-candidates",
+						Usage:   "the number of fragments per label to retrieve and rerank, of which --limit are kept",
+						Value:   20,
+						Sources: cli.EnvVars("BLOT_RERANK_CANDIDATES"),
+					},
+					&cli.FloatFlag{
+						Name: "mmr-lambda",
+						Usage: "diversify the fragments of each label by maximal marginal relevance, trading relevance, 1, \n" +
+							"against novelty, 0, eg. 0.5 to avoid near duplicates. Not diversified by default",
+						Sources: cli.EnvVars("BLOT_MMR_LAMBDA"),
+					},
+					&cli.StringFlag{
+						Name:  "session",
+						Usage: "persist the conversation in the named session, continuing it if it exists, creating it if it does not exist",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					conversation := &ai.Conversation{}
+					if cmd.IsSet("session") {
+						conversation, err = ai.OpenSession(cfg, cmd.String("session"))
+						if err != nil {
+							return err
+						}
+					}
+					return chat.New(cfg, conversation, os.Stdin, os.Stdout).Run()
+				},
+			},
+			{
+				Name: "serve",
+				Usage: "serves add, search, prompt and fill as a JSON http api, \n" +
+					"eg. POST /prompt {\"question\": \"...\", \"limits\": [\"QA:3\"], \"system_prompt\": \"...\"}",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "addr",
+						Usage:   "the address to listen on",
+						Value:   ":8080",
+						Sources: cli.EnvVars("BLOT_ADDR"),
+					},
+					&cli.DurationFlag{
+						Name:    "shutdown-timeout",
+						Usage:   "how long to wait for in flight requests when shutting down",
+						Value:   30 * time.Second,
+						Sources: cli.EnvVars("BLOT_SHUTDOWN_TIMEOUT"),
+					},
+					&cli.StringFlag{
+						Name:    "system-prompt",
+						Usage:   "the default system prompt, unless given in the request",
+						Sources: cli.EnvVars("BLOT_SYSTEM_PROMPT"),
+					},
+					&cli.StringSliceFlag{
+						Name:    "limit",
+						Usage:   "the default limits, unless given in the request, eg. --limit=QA:3 --limit=policies:2",
+						Value:   []string{"5"},
+						Sources: cli.EnvVars("BLOT_LIMITS"),
+					},
+					&cli.StringFlag{
+						Name:    "mode",
+						Usage:   "the default search mode, vector, lexical or hybrid, unless given in the request",
+						Value:   "vector",
+						Sources: cli.EnvVars("BLOT_MODE"),
+					},
+					&cli.BoolFlag{
+						Name:    "exact",
+						Usage:   "search all fragments instead of probing the approximate nearest neighbour index",
+						Sources: cli.EnvVars("BLOT_EXACT"),
+					},
+					&cli.IntFlag{
+						Name:    "probes",
+						Usage:   "the number of index lists to search, more probes are slower but more accurate",
+						Value:   8,
+						Sources: cli.EnvVars("BLOT_PROBES"),
+					},
+					&cli.StringFlag{
+						Name: "metric",
+						Usage: "the distance metric, cosine, dot, euclidean or manhattan, \n" +
+							"defaults to the metric recorded for the embedding model",
+						Sources: cli.EnvVars("BLOT_METRIC"),
+					},
+					&cli.FloatFlag{
+						Name: "min-score",
+						Usage: "drop fragments scoring below the minimum, eg. the cosine similarity in vector mode, or the relevance \n" +
+							"in [0, 1] when reranked. Not supported for lexical and hybrid mode without reranking",
+						Sources: cli.EnvVars("BLOT_MIN_SCORE"),
+					},
+					&cli.StringFlag{
+						Name: "rerank-model",
+						Usage: "rerank the retrieved fragments with a model, eg. VoyageAI/rerank-2, or any llm, \n" +
+							"eg. OpenAI/gpt-4o-mini, which is prompted to grade the fragments",
+						Sources: cli.EnvVars("BLOT_RERANK_MODEL"),
+					},
+					&cli.IntFlag{
+						Name:    "rerank-candidates",
+						Usage:   "the number of fragments per label to retrieve and rerank, of which --limit are kept",
+						Value:   20,
+						Sources: cli.EnvVars("BLOT_RERANK_CANDIDATES"),
+					},
+					&cli.FloatFlag{
+						Name: "mmr-lambda",
+						Usage: "diversify the fragments of each label by maximal marginal relevance, trading relevance, 1, \n" +
+							"against novelty, 0, eg. 0.5 to avoid near duplicates. Not diversified by default",
+						Sources: cli.EnvVars("BLOT_MMR_LAMBDA"),
+					},
+					&cli.StringFlag{
+						Name:    "chunk-strategy",
+						Usage:   "how to split added documents into fragments, none, fixed, paragraph or markdown",
+						Value:   "paragraph",
+						Sources: cli.EnvVars("BLOT_CHUNK_STRATEGY"),
+					},
+					&cli.IntFlag{
+						Name:    "chunk-size",
+						Usage:   "the maximum number of characters in a fragment",
+						Value:   4000,
+						Sources: cli.EnvVars("BLOT_CHUNK_SIZE"),
+					},
+					&cli.IntFlag{
+						Name:    "chunk-overlap",
+						Usage:   "the number of characters that a fragment overlaps the previous one, when cut within a paragraph",
+						Value:   200,
+						Sources: cli.EnvVars("BLOT_CHUNK_OVERLAP"),
+					},
+					&cli.IntFlag{
+						Name:    "embed-batch-size",
+						Usage:   "the maximum number of fragments to embed in one request",
+						Value:   64,
+						Sources: cli.EnvVars("BLOT_EMBED_BATCH_SIZE"),
+					},
+					&cli.IntFlag{
+						Name:    "embed-batch-tokens",
+						Usage:   "the maximum number of tokens, estimated as characters / 4, to embed in one request",
+						Value:   60000,
+						Sources: cli.EnvVars("BLOT_EMBED_BATCH_TOKENS"),
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+
+					ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+
+					cfg, err := ai.LoadConf(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
+					}
+
+					return server.New(cfg).ListenAndServe(ctx, cmd.String("addr"), cmd.Duration("shutdown-timeout"))
+				},
+			},
 			{
 				Name: "fill",
 				Flags: []cli.Flag{
@@ -420,6 +1440,35 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 						Name:    "with-headers",
 						Sources: cli.EnvVars("BLOT_WITH_HEADERS"),
 					},
+					&cli.BoolFlag{
+						Name:    "resume",
+						Usage:   "continue a previous fill, skipping the rows already written to the output file, failed rows are answered again",
+						Sources: cli.EnvVars("BLOT_RESUME"),
+					},
+					&cli.IntFlag{
+						Name:    "concurrency",
+						Usage:   "the number of rows to answer in parallel, rows are still written in order",
+						Value:   1,
+						Sources: cli.EnvVars("BLOT_CONCURRENCY"),
+					},
+					&cli.BoolFlag{
+						Name:    "keep-going",
+						Usage:   "write rows that could not be answered without answer and continue, the errors are recorded in <out>.errors",
+						Sources: cli.EnvVars("BLOT_KEEP_GOING"),
+					},
+					&cli.FloatFlag{
+						Name: "budget",
+						Usage: "the maximum cost, in USD, of the requests to models, eg. --budget=2.5. The fill is aborted before \n" +
+							"a request that could exceed it is sent, and can be continued with --resume",
+						Sources: cli.EnvVars("BLOT_BUDGET"),
+					},
+					&cli.IntFlag{
+						Name: "budget-output-tokens",
+						Usage: "the number of output tokens held back from the budget for every llm request, until its \n" +
+							"response tells how many were used",
+						Value:   4096,
+						Sources: cli.EnvVars("BLOT_BUDGET_OUTPUT_TOKENS"),
+					},
 					&cli.StringFlag{
 						Name:    "system-prompt",
 						Usage:   "the system prompt to use that will be used for the prompt when RAGing.",
@@ -434,6 +1483,55 @@ llm and embedding models to use from implemented vendors, ie. OpenAI, VertexAI,
 						Value:   []string{"5"},
 						Sources: cli.EnvVars("BLOT_LIMITS"),
 					},
+					&cli.StringFlag{
+						Name: "mode",
+						Usage: "how to rank fragments, vector, lexical or hybrid. \n" +
+							"vector ranks by embedding similarity, lexical by bm25 full text search \n" +
+							"and hybrid fuses both rankings",
+						Value:   "vector",
+						Sources: cli.EnvVars("BLOT_MODE"),
+					},
+					&cli.BoolFlag{
+						Name:    "exact",
+						Usage:   "search all fragments instead of probing the approximate nearest neighbour index",
+						Sources: cli.EnvVars("BLOT_EXACT"),
+					},
+					&cli.IntFlag{
+						Name:    "probes",
+						Usage:   "the number of index lists to search, more probes are slower but more accurate",
+						Value:   8,
+						Sources: cli.EnvVars("BLOT_PROBES"),
+					},
+					&cli.StringFlag{
+						Name: "metric",
+						Usage: "the distance metric, cosine, dot, euclidean or manhattan, \n" +
+							"defaults to the metric recorded for the embedding model",
+						Sources: cli.EnvVars("BLOT_METRIC"),
+					},
+					&cli.FloatFlag{
+						Name: "min-score",
+						Usage: "drop fragments scoring below the minimum, eg. the cosine similarity in vector mode, or the relevance \n" +
+							"in [0, 1] when reranked. Not supported for lexical and hybrid mode without reranking",
+						Sources: cli.EnvVars("BLOT_MIN_SCORE"),
+					},
+					&cli.StringFlag{
+						Name: "rerank-model",
+						Usage: "rerank the retrieved fragments with a model, eg. VoyageAI/rerank-2, or any llm, \n" +
+							"eg. OpenAI/gpt-4o-mini, which is prompted to grade the fragments",
+						Sources: cli.EnvVars("BLOT_RERANK_MODEL"),
+					},
+					&cli.IntFlag{
+						Name:    "rerank-candidates",
+						Usage:   "the number of fragments per label to retrieve and rerank, of which --limit are kept",
+						Value:   20,
+						Sources: cli.EnvVars("BLOT_RERANK_CANDIDATES"),
+					},
+					&cli.FloatFlag{
+						Name: "mmr-lambda",
+						Usage: "diversify the fragments of each label by maximal marginal relevance, trading relevance, 1, \n" +
+							"against novelty, 0, eg. 0.5 to avoid near duplicates. Not diversified by default",
+						Sources: cli.EnvVars("BLOT_MMR_LAMBDA"),
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 